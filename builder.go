@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+var builder *Builder
+
+type buildTask struct {
+	gameID uint
+	jobID  uint // 0 scans the game repository for new commits
+}
+
+// Builder runs scans and build jobs on a pool of workers. Tasks of one game
+// share a repository clone, so they are always run one at a time and in order.
+type Builder struct {
+	cfg Config
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[uint][]buildTask
+	busy    map[uint]bool
+	ready   []uint
+}
+
+func StartBuilder(cfg Config) {
+	builder = &Builder{
+		cfg:     cfg,
+		pending: make(map[uint][]buildTask),
+		busy:    make(map[uint]bool),
+	}
+	builder.cond = sync.NewCond(&builder.mu)
+
+	workers := cfg.BuildWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go builder.worker()
+	}
+
+	builder.recover()
+}
+
+// recover fails jobs interrupted by a restart and requeues the queued ones.
+func (b *Builder) recover() {
+	now := time.Now()
+	DB.Model(&BuildJob{}).Where("state = ?", JobRunning).Updates(map[string]interface{}{
+		"state":       JobFailed,
+		"error":       "interrupted by server restart",
+		"finished_at": now,
+	})
+
+	var jobs []BuildJob
+	DB.Where("state = ?", JobQueued).Order("id").Find(&jobs)
+	for _, job := range jobs {
+		b.Enqueue(job)
+	}
+}
+
+// ScheduleScan queues a fetch of the game repository, which in turn queues a
+// BuildJob for each new commit. It returns false if a scan is already pending.
+func (b *Builder) ScheduleScan(gameID uint) bool {
+	return b.schedule(buildTask{gameID: gameID})
+}
+
+// Enqueue queues an already persisted BuildJob.
+func (b *Builder) Enqueue(job BuildJob) {
+	b.schedule(buildTask{gameID: job.GameID, jobID: job.ID})
+}
+
+func (b *Builder) schedule(task buildTask) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, t := range b.pending[task.gameID] {
+		if t == task {
+			return false
+		}
+	}
+
+	b.pending[task.gameID] = append(b.pending[task.gameID], task)
+	if !b.busy[task.gameID] {
+		b.busy[task.gameID] = true
+		b.ready = append(b.ready, task.gameID)
+		b.cond.Signal()
+	}
+	return true
+}
+
+func (b *Builder) worker() {
+	for {
+		b.mu.Lock()
+		for len(b.ready) == 0 {
+			b.cond.Wait()
+		}
+		gameID := b.ready[0]
+		b.ready = b.ready[1:]
+		b.mu.Unlock()
+
+		for {
+			task, ok := b.next(gameID)
+			if !ok {
+				break
+			}
+			b.run(task)
+		}
+	}
+}
+
+// next pops the next task of a game, releasing the game once it has none.
+func (b *Builder) next(gameID uint) (buildTask, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tasks := b.pending[gameID]
+	if len(tasks) == 0 {
+		delete(b.pending, gameID)
+		delete(b.busy, gameID)
+		return buildTask{}, false
+	}
+	b.pending[gameID] = tasks[1:]
+	return tasks[0], true
+}
+
+func (b *Builder) run(task buildTask) {
+	if task.jobID == 0 {
+		b.scan(task.gameID)
+		return
+	}
+
+	var job BuildJob
+	if err := DB.First(&job, task.jobID).Error; err != nil {
+		log.Println("Build job not found:", task.jobID, err)
+		return
+	}
+	if job.State != JobQueued {
+		return
+	}
+
+	started := time.Now()
+	job.State = JobRunning
+	job.StartedAt = &started
+	DB.Save(&job)
+
+	var buf bytes.Buffer
+	jl := log.New(io.MultiWriter(log.Writer(), &buf), log.Prefix(), log.Flags())
+	jl.Printf("Building game %d commit %s %s\n", job.GameID, job.CommitHash, job.Tag)
+
+	err := runBuildJob(b.cfg, &job, jl)
+
+	finished := time.Now()
+	job.FinishedAt = &finished
+	job.State = JobSucceeded
+	if err != nil {
+		jl.Println("Build failed:", err)
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	job.Log = buf.String()
+
+	if err := DB.Save(&job).Error; err != nil {
+		log.Println("Failed saving build job:", err)
+	}
+}
+
+func (b *Builder) scan(gameID uint) {
+	var game Game
+	if err := DB.First(&game, gameID).Error; err != nil {
+		log.Println("Game not found:", gameID, err)
+		return
+	}
+
+	jobs, err := processGame(b.cfg, game)
+	if err != nil {
+		log.Printf("Failed processing %s: %s\n", game.ShortName, err)
+	}
+
+	for _, job := range jobs {
+		b.Enqueue(job)
+	}
+}
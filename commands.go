@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Commands run instead of the server when given after the config file, e.g.
+// `spring-repo-server config.yaml export --out /srv/rapid`.
+var commands = map[string]func(cfg Config, args []string) error{
+	"export":      runExport,
+	"gc":          runGC,
+	"import":      runImport,
+	"replicate":   runReplicate,
+	"verify-pool": runVerifyPool,
+}
+
+func RunCommand(cfg Config, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: %s config.yaml [%s] [flags]\n", os.Args[0], strings.Join(names, "|"))
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return cmd(cfg, args)
+}
@@ -13,6 +13,26 @@ type Config struct {
 	PoolPath     string `yaml:"pool_path"`
 	BackLog      int    `yaml:"back_log"`
 	CookieSecret string `yaml:"cookiesecret"`
+	PollInterval int    `yaml:"poll_interval"` // minutes, fallback when webhooks are missed
+	BuildWorkers int    `yaml:"build_workers"`
+	HashSHA256   bool   `yaml:"hash_sha256"`
+	// files hashed and compressed concurrently per build, 0 uses every CPU
+	BuildParallelism int `yaml:"build_parallelism"`
+	// minutes between mirror spot checks
+	MirrorCheckInterval int `yaml:"mirror_check_interval"`
+	// hours between background pool verifications
+	VerifyPoolInterval int `yaml:"verify_pool_interval"`
+	// where pool objects are kept: "fs" (default) under PoolPath, or "s3"
+	PoolStore string   `yaml:"pool_store"`
+	S3        S3Config `yaml:"s3"`
+	// rapid master to replicate, e.g. https://repos.springrts.com, empty
+	// disables replication
+	Upstream string `yaml:"upstream"`
+	// minutes between replication passes
+	ReplicateInterval int `yaml:"replicate_interval"`
+	// base URL of this server, replicated games are advertised in repos.gz
+	// as <public_url>/<shortname>
+	PublicURL string `yaml:"public_url"`
 }
 
 func LoadConfig() (Config, error) {
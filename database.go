@@ -40,10 +40,130 @@ func InitDB(cfg Config) {
 		log.Fatal("failed to connect database:", err)
 	}
 
-	err = DB.AutoMigrate(&Game{}, &GameVersion{}, &File{}, &VersionFile{}, &Admin{})
+	seedRefs := !DB.Migrator().HasTable(&GameRef{})
+	seedChannels := !DB.Migrator().HasTable(&Channel{})
+
+	// Both unique indexes need the duplicates gone before AutoMigrate
+	dupeFiles := DB.Migrator().HasTable(&File{}) && !DB.Migrator().HasIndex(&File{}, "idx_files_md5")
+	dupePaths := DB.Migrator().HasTable(&VersionFile{}) && !DB.Migrator().HasIndex(&VersionFile{}, "idx_version_file_path")
+	if dupeFiles || dupePaths {
+		if err := dedupeFiles(dupeFiles, dupePaths); err != nil {
+			log.Fatal("failed to deduplicate files:", err)
+		}
+	}
+
+	unpublishBuilds := publishedDefaultsTrue()
+
+	// Version hashes used to be unique across all games
+	for _, idx := range []string{"idx_game_versions_version_hash", "idx_version_aliases_version_hash"} {
+		if err := DB.Exec("DROP INDEX IF EXISTS " + idx).Error; err != nil {
+			log.Fatal("failed to drop index:", err)
+		}
+	}
+
+	err = DB.AutoMigrate(&Game{}, &GameRef{}, &GameVersion{}, &VersionAlias{}, &VersionDepend{}, &Channel{}, &File{}, &BlobFile{}, &VersionFile{}, &BuildJob{}, &Mirror{}, &Admin{})
 	if err != nil {
 		log.Fatal("failed to migrate:", err)
 	}
 
+	// Games created before refs existed keep building origin/HEAD as :test
+	if seedRefs {
+		var games []Game
+		DB.Find(&games)
+		for _, g := range games {
+			ref := DefaultRef(g.ID)
+			DB.Create(&ref)
+		}
+	}
+
+	// Versions built before aliases existed are their own alias
+	err = DB.Exec(`INSERT INTO version_aliases (game_id, game_version_id, version_hash, created_at)
+		SELECT game_id, id, version_hash, created_at FROM game_versions
+		WHERE NOT EXISTS (SELECT 1 FROM version_aliases a
+			WHERE a.game_id = game_versions.game_id AND a.version_hash = game_versions.version_hash)`).Error
+	if err != nil {
+		log.Fatal("failed to migrate aliases:", err)
+	}
+
+	// Builds gc removed before collected jobs were marked
+	err = DB.Model(&BuildJob{}).Where("state = ? AND game_version_id IS NULL", JobSucceeded).Update("state", JobCollected).Error
+	if err != nil {
+		log.Fatal("failed to migrate build jobs:", err)
+	}
+
+	// Builds were saved published while the column defaulted to true, commit
+	// builds go back to unpublished so gc can expire them. Tagged, imported
+	// and uploaded versions stay published.
+	if unpublishBuilds {
+		err = DB.Exec(`ALTER TABLE game_versions ALTER COLUMN published SET DEFAULT false`).Error
+		if err == nil {
+			err = DB.Exec(`UPDATE game_versions SET published = false
+				WHERE published
+				AND EXISTS (SELECT 1 FROM version_aliases a WHERE a.game_version_id = game_versions.id)
+				AND NOT EXISTS (SELECT 1 FROM version_aliases a WHERE a.game_version_id = game_versions.id
+					AND a.version_hash !~ '^(git:)?[0-9a-f]{40}$')`).Error
+		}
+		if err != nil {
+			log.Fatal("failed to migrate published versions:", err)
+		}
+	}
+
+	// The stable alias used to be hard-coded to the newest published version
+	if seedChannels {
+		var games []Game
+		DB.Find(&games)
+		for _, g := range games {
+			ch := DefaultChannel(g.ID)
+			DB.Create(&ch)
+		}
+	}
+
 	CreateSampleAdmin()
 }
+
+// publishedDefaultsTrue tells whether game_versions.published still has the
+// old default of true, which every build was saved with.
+func publishedDefaultsTrue() bool {
+	var def *string
+	DB.Raw(`SELECT column_default FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'game_versions' AND column_name = 'published'`).Scan(&def)
+	return def != nil && *def == "true"
+}
+
+// dedupeFiles merges File rows sharing an md5 into the oldest one and drops
+// repeated paths within a version, so the unique indexes builds rely on can
+// be created. It runs in one transaction, a failed upgrade leaves no half
+// merged files behind.
+func dedupeFiles(files bool, paths bool) error {
+	var queries []string
+	if files {
+		queries = append(queries,
+			`CREATE TEMP TABLE file_dupes ON COMMIT DROP AS
+				SELECT f.id, k.keep FROM files f
+				JOIN (SELECT md5_sum, MIN(id) AS keep FROM files GROUP BY md5_sum) k ON k.md5_sum = f.md5_sum
+				WHERE f.id <> k.keep`)
+		if DB.Migrator().HasTable(&VersionFile{}) {
+			queries = append(queries, `UPDATE version_files SET file_id = d.keep FROM file_dupes d WHERE version_files.file_id = d.id`)
+		}
+		// Databases from before the blob cache don't have the table yet
+		if DB.Migrator().HasTable(&BlobFile{}) {
+			queries = append(queries, `UPDATE blob_files SET file_id = d.keep FROM file_dupes d WHERE blob_files.file_id = d.id`)
+		}
+		queries = append(queries,
+			`DELETE FROM files WHERE id IN (SELECT id FROM file_dupes)`,
+			`DROP INDEX IF EXISTS idx_files_md5_sum`)
+	}
+	if paths {
+		queries = append(queries, `DELETE FROM version_files v USING version_files o
+			WHERE v.game_version_id = o.game_version_id AND v.path = o.path AND v.id > o.id`)
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, q := range queries {
+			if err := tx.Exec(q).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runExport(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "", "directory to write the static rapid tree to")
+	baseURL := fs.String("base-url", "", "public URL the tree is served from, advertised in repos.gz (defaults to each game's repo URL)")
+	incremental := fs.Bool("incremental", false, "only write files that changed since the last export")
+	fs.Parse(args)
+
+	if *out == "" {
+		return errors.New("export: --out is required")
+	}
+
+	e := exporter{
+		cfg:         cfg,
+		out:         *out,
+		baseURL:     strings.TrimSuffix(*baseURL, "/"),
+		incremental: *incremental,
+	}
+	if err := e.run(); err != nil {
+		return err
+	}
+
+	log.Printf("Export to %s done: %d files written, %d unchanged\n", e.out, e.written, e.skipped)
+	return nil
+}
+
+// exporter writes a rapid tree that any plain web server or rsync mirror can
+// serve: repos.gz, <shortname>/versions.gz, <shortname>/packages/<md5>.sdp
+// and the shared pool/.
+type exporter struct {
+	cfg         Config
+	out         string
+	baseURL     string
+	incremental bool
+
+	written int
+	skipped int
+}
+
+func (e *exporter) run() error {
+	err := e.writeIndex("repos.gz", func(w io.Writer) error {
+		return WriteRepos(w, func(g Game) []string {
+			if e.baseURL == "" {
+				return []string{g.RepoURL}
+			}
+			return []string{e.baseURL + "/" + g.ShortName}
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var games []Game
+	DB.Order("short_name").Find(&games)
+
+	for _, game := range games {
+		if err := e.exportGame(game); err != nil {
+			return fmt.Errorf("export %s: %w", game.ShortName, err)
+		}
+	}
+
+	return e.exportPool()
+}
+
+func (e *exporter) exportGame(game Game) error {
+	err := e.writeIndex(filepath.Join(game.ShortName, "versions.gz"), func(w io.Writer) error {
+		return WriteVersions(w, game)
+	})
+	if err != nil {
+		return err
+	}
+
+	var md5s []string
+	DB.Model(&GameVersion{}).Where("game_id = ?", game.ID).Order("id").Pluck("version_md5", &md5s)
+
+	for _, md5sum := range md5s {
+		rel := filepath.Join(game.ShortName, "packages", md5sum+".sdp")
+		if e.incremental && e.exists(rel) {
+			e.skipped++
+			continue
+		}
+
+		src := packagePath(e.cfg, md5sum)
+		if _, err := os.Stat(src); err != nil {
+			if err := writePackage(e.cfg, DB, md5sum); err != nil {
+				return err
+			}
+		}
+		if err := e.copyFile(src, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *exporter) exportPool() error {
+	var md5s []string
+	err := DB.Model(&File{}).
+		Distinct("files.md5_sum").
+		Joins("INNER JOIN version_files ON version_files.file_id = files.id").
+		Order("files.md5_sum").
+		Pluck("files.md5_sum", &md5s).Error
+	if err != nil {
+		return err
+	}
+
+	for _, md5sum := range md5s {
+		rel := filepath.Join("pool", md5sum[0:2], md5sum[2:]+".gz")
+		if e.incremental && e.exists(rel) {
+			e.skipped++
+			continue
+		}
+		if err := e.copyObject(md5sum, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject copies a pool object into the tree, hard-linking it when the
+// pool is on the local disk.
+func (e *exporter) copyObject(md5sum, rel string) error {
+	if fs, ok := pool.(*fsStore); ok {
+		return e.copyFile(fs.path(md5sum), rel)
+	}
+
+	r, err := pool.Open(md5sum)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return e.replace(filepath.Join(e.out, rel), func(f *os.File) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+}
+
+func (e *exporter) exists(rel string) bool {
+	_, err := os.Stat(filepath.Join(e.out, rel))
+	return err == nil
+}
+
+// writeIndex gzips a generated listing into rel. In incremental mode an
+// existing file with the same content is left alone.
+func (e *exporter) writeIndex(rel string, generate func(io.Writer) error) error {
+	var plain bytes.Buffer
+	if err := generate(&plain); err != nil {
+		return err
+	}
+
+	dst := filepath.Join(e.out, rel)
+	if e.incremental {
+		if old, err := readGzipFile(dst); err == nil && bytes.Equal(old, plain.Bytes()) {
+			e.skipped++
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(plain.Bytes())
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return e.replace(dst, func(f *os.File) error {
+		_, err := f.Write(buf.Bytes())
+		return err
+	})
+}
+
+// copyFile hard-links src into the tree when both live on the same
+// filesystem, and copies it otherwise.
+func (e *exporter) copyFile(src, rel string) error {
+	dst := filepath.Join(e.out, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if err := linkOrCopy(src, dst, ".export-*", false); err != nil {
+		return err
+	}
+	e.written++
+	return nil
+}
+
+// linkOrCopy puts src at dst through a temp file named after pattern next to
+// dst, so readers never see a missing or partial file. It hard-links unless
+// copyOnly is set or the link fails, e.g. across filesystems.
+func linkOrCopy(src, dst, pattern string, copyOnly bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), pattern)
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	defer os.Remove(name)
+
+	if !copyOnly {
+		tmp.Close()
+		os.Remove(name)
+		if err := os.Link(src, name); err == nil {
+			return os.Rename(name, dst)
+		}
+		if tmp, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name, dst)
+}
+
+// replace writes dst through a temp file so mirrors never serve partial files.
+func (e *exporter) replace(dst string, write func(*os.File) error) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+
+	e.written++
+	return nil
+}
+
+func readGzipFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return io.ReadAll(gz)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkOrCopy(t *testing.T) {
+	for _, copyOnly := range []bool{false, true} {
+		dir := t.TempDir()
+		src := filepath.Join(dir, "src")
+		dst := filepath.Join(dir, "dst")
+		if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := linkOrCopy(src, dst, ".export-*", copyOnly); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(dst); err != nil || string(got) != "new" {
+			t.Errorf("copyOnly %v: dst has %q, %v", copyOnly, got, err)
+		}
+
+		si, _ := os.Stat(src)
+		di, _ := os.Stat(dst)
+		if linked := os.SameFile(si, di); linked == copyOnly {
+			t.Errorf("copyOnly %v: hard-linked %v", copyOnly, linked)
+		}
+
+		if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+			t.Errorf("copyOnly %v: temp files left behind: %v", copyOnly, entries)
+		}
+	}
+}
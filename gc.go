@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Postgres advisory lock held shared by builds and exclusively by gc, so gc
+// never removes a pool object a running build is about to link.
+const poolLockKey = 0x72617069640067
+
+var errDryRun = errors.New("dry run")
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// GCReport lists what a garbage collection removed, or would remove.
+type GCReport struct {
+	Versions []GameVersion
+	Files    []File
+	Objects  []string
+	Packages []string
+	Bytes    int64
+}
+
+func runGC(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	fs.Parse(args)
+
+	report, err := CollectGarbage(cfg, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range report.Versions {
+		fmt.Printf("version %s %s (%s)\n", v.VersionHash, v.FullName, v.VersionMD5)
+	}
+	for _, path := range report.Packages {
+		fmt.Printf("package %s\n", path)
+	}
+	for _, md5sum := range report.Objects {
+		fmt.Printf("object  %s\n", md5sum)
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	log.Printf("%s %d versions, %d files, %d pool objects (%d bytes) and %d packages\n",
+		verb, len(report.Versions), len(report.Files), len(report.Objects), report.Bytes, len(report.Packages))
+	return nil
+}
+
+// lockPool takes the pool lock on a dedicated connection and returns the
+// function releasing it.
+func lockPool(exclusive bool) (func(), error) {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, unlock := "pg_advisory_lock_shared", "pg_advisory_unlock_shared"
+	if exclusive {
+		lock, unlock = "pg_advisory_lock", "pg_advisory_unlock"
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT "+lock+"($1)", poolLockKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return func() {
+		conn.ExecContext(ctx, "SELECT "+unlock+"($1)", poolLockKey)
+		conn.Close()
+	}, nil
+}
+
+// CollectGarbage deletes the versions that fell out of the retention policy
+// of their game, then the files, pool objects and packages nothing references
+// anymore. A dry run rolls the deletions back and leaves the disk alone.
+func CollectGarbage(cfg Config, dryRun bool) (*GCReport, error) {
+	unlock, err := lockPool(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	report := &GCReport{}
+
+	var games []Game
+	DB.Where("keep_builds > 0").Find(&games)
+	for _, game := range games {
+		expired, err := expiredVersions(game)
+		if err != nil {
+			return nil, fmt.Errorf("gc %s: %w", game.ShortName, err)
+		}
+		report.Versions = append(report.Versions, expired...)
+	}
+
+	// What is left once the deletions are done, the same for dry runs
+	packages := make(map[string]int)
+	var versionMD5s []string
+	DB.Model(&GameVersion{}).Pluck("version_md5", &versionMD5s)
+	for _, md5sum := range versionMD5s {
+		packages[md5sum]++
+	}
+	for _, v := range report.Versions {
+		packages[v.VersionMD5]--
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		ids := make([]uint, 0, len(report.Versions))
+		for _, v := range report.Versions {
+			ids = append(ids, v.ID)
+		}
+
+		for start := 0; start < len(ids); start += insertBatchSize {
+			chunk := ids[start:min(start+insertBatchSize, len(ids))]
+
+			err := tx.Model(&BuildJob{}).Where("game_version_id IN ?", chunk).Updates(map[string]interface{}{
+				"game_version_id": nil,
+				"state":           JobCollected,
+			}).Error
+			if err != nil {
+				return err
+			}
+			for _, model := range []interface{}{&VersionFile{}, &VersionDepend{}, &VersionAlias{}} {
+				if err := tx.Where("game_version_id IN ?", chunk).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Delete(&GameVersion{}, chunk).Error; err != nil {
+				return err
+			}
+		}
+
+		err := tx.Where("NOT EXISTS (SELECT 1 FROM version_files WHERE version_files.file_id = files.id)").
+			Find(&report.Files).Error
+		if err != nil {
+			return err
+		}
+
+		for start := 0; start < len(report.Files); start += insertBatchSize {
+			chunk := make([]uint, 0, insertBatchSize)
+			for _, f := range report.Files[start:min(start+insertBatchSize, len(report.Files))] {
+				chunk = append(chunk, f.ID)
+			}
+
+			if err := tx.Where("file_id IN ?", chunk).Delete(&BlobFile{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&File{}, chunk).Error; err != nil {
+				return err
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	// Objects of the removed files, plus any left behind by failed builds
+	removed := make(map[string]bool, len(report.Files))
+	for _, f := range report.Files {
+		removed[f.MD5Sum] = true
+	}
+	var fileMD5s []string
+	DB.Model(&File{}).Pluck("md5_sum", &fileMD5s)
+	known := make(map[string]bool, len(fileMD5s))
+	for _, md5sum := range fileMD5s {
+		if !removed[md5sum] {
+			known[md5sum] = true
+		}
+	}
+
+	report.Objects, err = poolOrphans(known)
+	if err != nil {
+		return nil, err
+	}
+	for md5sum, n := range packages {
+		if n <= 0 {
+			path := packagePath(cfg, md5sum)
+			if _, err := os.Stat(path); err == nil {
+				report.Packages = append(report.Packages, path)
+			}
+		}
+	}
+
+	for _, md5sum := range report.Objects {
+		if size, err := pool.Stat(md5sum); err == nil {
+			report.Bytes += size
+		}
+		if dryRun {
+			continue
+		}
+		if err := pool.Delete(md5sum); err != nil {
+			log.Printf("Failed removing pool object %s: %s\n", md5sum, err)
+		}
+	}
+	for _, path := range report.Packages {
+		if fi, err := os.Stat(path); err == nil {
+			report.Bytes += fi.Size()
+		}
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Println("Failed removing", err)
+		}
+	}
+
+	return report, nil
+}
+
+// expiredVersions applies the retention policy of a game: published and
+// tagged versions are kept, as are versions a channel or ref points at and
+// the newest KeepBuilds of the other builds.
+func expiredVersions(game Game) ([]GameVersion, error) {
+	keep := make(map[uint]bool)
+
+	var channels []Channel
+	if err := DB.Where("game_id = ?", game.ID).Find(&channels).Error; err != nil {
+		return nil, err
+	}
+	for _, ch := range channels {
+		v, err := ch.Resolve(DB)
+		if err != nil {
+			return nil, fmt.Errorf("channel %s: %w", ch.Name, err)
+		}
+		if v != nil {
+			keep[v.ID] = true
+		}
+	}
+
+	var refVersions []uint
+	DB.Model(&GameRef{}).Where("game_id = ? AND version_id IS NOT NULL", game.ID).Pluck("version_id", &refVersions)
+	for _, id := range refVersions {
+		keep[id] = true
+	}
+
+	var versions []GameVersion
+	DB.Preload("Aliases").Where("game_id = ?", game.ID).Order("id DESC").Find(&versions)
+
+	var expired []GameVersion
+	builds := 0
+	for _, v := range versions {
+		if v.Published || isTagged(v) {
+			continue
+		}
+		builds++
+		if builds > game.KeepBuilds && !keep[v.ID] {
+			expired = append(expired, v)
+		}
+	}
+	return expired, nil
+}
+
+// isTagged tells whether any build of the version came from a git tag rather
+// than a plain commit.
+func isTagged(v GameVersion) bool {
+	for _, a := range v.Aliases {
+		if !commitHash.MatchString(strings.TrimPrefix(a.VersionHash, "git:")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+// noBlobs is the blobReader of versions whose entries all have Content.
+type noBlobs struct{}
+
+func (noBlobs) ReadBlob(id string, fn func(io.Reader) error) error {
+	return fmt.Errorf("no blob %s", id)
+}
+
+func (noBlobs) Close() error { return nil }
+
+// testBuild creates a version like a build of a commit would.
+func testBuild(t *testing.T, cfg Config, game Game, alias string, content string) GameVersion {
+	t.Helper()
+	entries := []treeEntry{{Path: "modinfo.lua", Size: int64(len(content)), Content: []byte(content)}}
+	openBlobs := func() (blobReader, error) { return noBlobs{}, nil }
+
+	v, err := createVersion(game, alias, game.ShortName+" "+alias, nil, entries, openBlobs, cfg, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *v
+}
+
+func TestCollectGarbageKeepsBuilds(t *testing.T) {
+	cfg := testDB(t)
+
+	game := Game{ShortName: "gc", KeepBuilds: 2}
+	if err := DB.Create(&game).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var builds []GameVersion
+	for i := 0; i < 5; i++ {
+		sha := strings.Repeat(fmt.Sprintf("%x", i+1), 40)
+		builds = append(builds, testBuild(t, cfg, game, "git:"+sha, fmt.Sprintf("return {build=%d}\n", i)))
+	}
+	tagged := testBuild(t, cfg, game, "git:v1.0", "return {tag='v1.0'}\n")
+
+	for _, v := range builds {
+		var got GameVersion
+		DB.First(&got, v.ID)
+		if got.Published {
+			t.Fatalf("build %s was created published", v.VersionHash)
+		}
+	}
+
+	report, err := CollectGarbage(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Versions) != 3 {
+		t.Errorf("gc removed %d versions, want 3", len(report.Versions))
+	}
+
+	// The newest KeepBuilds builds and the tagged version are left
+	var left []uint
+	DB.Model(&GameVersion{}).Where("game_id = ?", game.ID).Order("id").Pluck("id", &left)
+	want := []uint{builds[3].ID, builds[4].ID, tagged.ID}
+	if fmt.Sprint(left) != fmt.Sprint(want) {
+		t.Errorf("versions left %v, want %v", left, want)
+	}
+
+	// Their files are gone from the pool
+	for _, v := range builds[:3] {
+		var files int64
+		DB.Model(&VersionFile{}).Where("game_version_id = ?", v.ID).Count(&files)
+		if files != 0 {
+			t.Errorf("%d files left of %s", files, v.VersionHash)
+		}
+	}
+	if len(report.Objects) != 3 {
+		t.Errorf("gc removed %d pool objects, want 3", len(report.Objects))
+	}
+}
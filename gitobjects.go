@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// treeEntry is one file of a version being built.
+type treeEntry struct {
+	// Path is the lowercased path inside the archive
+	Path    string
+	Size    int64
+	BlobSHA string
+	// Source names the content to the blobReader when it isn't a git blob,
+	// e.g. the path inside an uploaded archive
+	Source string
+	// Content replaces the blob, e.g. modinfo.lua with $VERSION substituted
+	Content []byte
+	// File is set when the content is already in the pool
+	File *File
+}
+
+// key identifies the content of an entry before it is hashed.
+func (e treeEntry) key() string {
+	switch {
+	case e.Content != nil:
+		return "path:" + e.Path
+	case e.File != nil:
+		return "md5:" + e.File.MD5Sum
+	case e.BlobSHA != "":
+		return e.BlobSHA
+	}
+	return "src:" + e.Source
+}
+
+// blobReader streams blobs by id. A reader is not safe for concurrent use,
+// parallel builds open one per worker.
+type blobReader interface {
+	ReadBlob(id string, fn func(io.Reader) error) error
+	Close() error
+}
+
+// read streams the content of the entry to fn.
+func (e treeEntry) read(br blobReader, fn func(io.Reader) error) error {
+	switch {
+	case e.Content != nil:
+		return fn(bytes.NewReader(e.Content))
+	case e.BlobSHA != "":
+		return br.ReadBlob(e.BlobSHA, fn)
+	case e.Source != "":
+		return br.ReadBlob(e.Source, fn)
+	}
+	return fmt.Errorf("%s has no content", e.Path)
+}
+
+// readAll reads the whole content of the entry.
+func (e treeEntry) readAll(br blobReader) ([]byte, error) {
+	var data []byte
+	err := e.read(br, func(r io.Reader) error {
+		var err error
+		data, err = io.ReadAll(r)
+		return err
+	})
+	return data, err
+}
+
+// listGitTree lists the files of a commit straight from the object store, so
+// builds never need a checkout.
+func listGitTree(repoPath string, commit string, jl *log.Logger) ([]treeEntry, error) {
+	out, err := exec.Command("git", "-C", repoPath, "ls-tree", "-r", "-l", "-z", commit).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree of %s: %w", commit, err)
+	}
+
+	var entries []treeEntry
+	for _, rec := range bytes.Split(out, []byte{0}) {
+		if len(rec) == 0 {
+			continue
+		}
+
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		meta, path, ok := strings.Cut(string(rec), "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected ls-tree output: %q", rec)
+		}
+
+		if fields[1] != "blob" {
+			jl.Printf("Skipping %s %s\n", fields[1], path)
+			continue
+		}
+		if fields[0] == "120000" {
+			jl.Printf("Skipping symlink %s\n", path)
+			continue
+		}
+
+		path = strings.ToLower(path)
+		if strings.HasPrefix(path, ".git") {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for %s: %w", path, err)
+		}
+
+		entries = append(entries, treeEntry{
+			Path:    path,
+			Size:    size,
+			BlobSHA: fields[2],
+		})
+	}
+
+	return entries, nil
+}
+
+// catFile reads blobs through one long running `git cat-file --batch`.
+type catFile struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+func newCatFile(repoPath string) (*catFile, error) {
+	cmd := exec.Command("git", "-C", repoPath, "cat-file", "--batch")
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &catFile{
+		cmd: cmd,
+		in:  in,
+		out: bufio.NewReaderSize(out, 64*1024),
+	}, nil
+}
+
+// ReadBlob streams a blob to fn. The reader is only valid during the call.
+func (c *catFile) ReadBlob(sha string, fn func(io.Reader) error) error {
+	if _, err := fmt.Fprintf(c.in, "%s\n", sha); err != nil {
+		return err
+	}
+
+	// <sha> SP <type> SP <size> LF, or <sha> SP missing LF
+	header, err := c.out.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return fmt.Errorf("blob %s: %s", sha, strings.TrimSpace(header))
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", sha, err)
+	}
+
+	body := io.LimitReader(c.out, size)
+	var ferr error
+	if fields[1] != "blob" {
+		ferr = fmt.Errorf("%s is a %s, not a blob", sha, fields[1])
+	} else {
+		ferr = fn(body)
+	}
+
+	// Keep the stream in sync even if fn stopped early
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	if b, err := c.out.ReadByte(); err != nil || b != '\n' {
+		return errors.New("cat-file: missing blob terminator")
+	}
+	return ferr
+}
+
+func (c *catFile) Close() error {
+	c.in.Close()
+	return c.cmd.Wait()
+}
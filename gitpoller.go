@@ -1,223 +1,310 @@
 package main
 
 import (
-	"compress/gzip"
-	"crypto/md5"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func StartGitPoller(cfg Config) {
+	interval := time.Duration(cfg.PollInterval) * time.Minute
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
 	go func() {
 		for {
-			checkRepos(cfg)
-			time.Sleep(5 * time.Minute)
+			checkRepos()
+			time.Sleep(interval)
 		}
 	}()
 }
 
-func checkRepos(cfg Config) {
+// EnqueueGame asks the builder to look for new commits of a single game as
+// soon as possible, e.g. after a webhook. It returns false when a scan is
+// already pending for that game.
+func EnqueueGame(id uint) bool {
+	return builder.ScheduleScan(id)
+}
+
+func checkRepos() {
 	var games []Game
 	DB.Find(&games)
 
 	for _, game := range games {
-		processGame(cfg, game)
+		builder.ScheduleScan(game.ID)
 	}
 }
 
-var (
-	// Strictly match: return { ... }
-	blockRegex = regexp.MustCompile(`(?s)^\s*return\s*\{\s*(.*?)\s*\}\s*$`)
-
-	// Strictly match one key/value line
-	fieldRegex = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*(?:'([^']*)'|([0-9]+))\s*,?\s*$`)
-)
-
-func parseLuaTable(input string) (map[string]string, error) {
-	result := make(map[string]string)
+// cloneMirror makes a bare clone that keeps the remote branches under
+// refs/remotes/origin like a regular clone. Builds read straight from its
+// objects, so it never needs a working tree.
+func cloneMirror(url string, repoPath string) error {
+	cmds := [][]string{
+		{"clone", "--bare", url, repoPath},
+		{"-C", repoPath, "config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"},
+		{"-C", repoPath, "fetch", "--tags", "origin"},
+		{"-C", repoPath, "remote", "set-head", "origin", "--auto"},
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			os.RemoveAll(repoPath)
+			return fmt.Errorf("failed to clone repo: git %s: %w: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	return nil
+}
 
-	// 1️⃣ Validate and extract block
-	blockMatch := blockRegex.FindStringSubmatch(input)
-	if blockMatch == nil {
-		return nil, errors.New("input must be a single 'return { ... }' block")
+// isBareRepo reports whether repoPath is a bare git repository.
+func isBareRepo(repoPath string) (bool, error) {
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "--is-bare-repository").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("git rev-parse: %w: %s", err, strings.TrimSpace(string(out)))
 	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
 
-	body := blockMatch[1]
+// processGame updates the clone of a game and records a queued BuildJob for
+// every commit in the backlog of each tracked ref that has no version yet.
+func processGame(cfg Config, game Game) ([]BuildJob, error) {
+	// Imported and upload only games have nothing to poll
+	if game.GitURL == "" {
+		return nil, nil
+	}
 
-	// 2️⃣ Split into lines and validate each
-	lines := strings.Split(body, "\n")
+	repoPath := filepath.Join(cfg.ReposPath, game.ShortName)
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+	// Clones from before the bare mirrors, or broken ones, are replaced
+	if _, err := os.Stat(repoPath); err == nil {
+		bare, err := isBareRepo(repoPath)
+		if err != nil {
+			log.Printf("Re-cloning %s: %s\n", repoPath, err)
+		} else if !bare {
+			log.Printf("Re-cloning %s as a bare mirror\n", repoPath)
+		}
+		if !bare {
+			if err := os.RemoveAll(repoPath); err != nil {
+				return nil, err
+			}
 		}
+	}
 
-		match := fieldRegex.FindStringSubmatch(line)
-		if match == nil {
-			return nil, fmt.Errorf("invalid line: %s", line)
+	// Clone repo if it doesn't exist
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		if err := cloneMirror(game.GitURL, repoPath); err != nil {
+			return nil, err
 		}
+	}
 
-		key := match[1]
+	// Fetch latest changes and tags
+	if out, err := exec.Command("git", "-C", repoPath, "fetch", "--tags", "--prune", "origin").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to fetch repo: %w: %s", err, out)
+	}
 
-		var value string
-		if match[2] != "" {
-			value = match[2] // string
-		} else {
-			value = match[3] // number
-		}
+	var refs []GameRef
+	DB.Where("game_id = ?", game.ID).Order("id").Find(&refs)
 
-		result[key] = value
+	var jobs []BuildJob
+	for i := range refs {
+		refJobs, err := processRef(cfg, repoPath, game, &refs[i])
+		if err != nil {
+			log.Printf("Failed processing %s ref %s: %s\n", game.ShortName, refs[i].Name, err)
+			continue
+		}
+		jobs = append(jobs, refJobs...)
 	}
 
-	return result, nil
+	return jobs, nil
 }
 
-func processGame(cfg Config, game Game) {
-	repoPath := filepath.Join(cfg.ReposPath, game.ShortName)
+type refCommit struct {
+	Hash string
+	Tag  string
+}
 
-	// Clone repo if it doesn't exist
-	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-		if err := exec.Command("git", "clone", game.GitURL, repoPath).Run(); err != nil {
-			fmt.Println("Failed to clone repo:", err)
-			return
+// listRefCommits returns the backlog of a ref, newest first.
+func listRefCommits(cfg Config, repoPath string, ref GameRef) ([]refCommit, error) {
+	var commits []refCommit
+
+	if ref.Kind == RefTag {
+		out, err := exec.Command("git", "-C", repoPath, "tag", "--list", "--sort=-creatordate", ref.Name).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
 		}
-	}
 
-	// Fetch latest changes and tags
-	if err := exec.Command("git", "-C", repoPath, "fetch", "--tags").Run(); err != nil {
-		fmt.Println("Failed to fetch repo:", err)
-		return
+		for _, tag := range strings.Fields(string(out)) {
+			if len(commits) >= cfg.BackLog {
+				break
+			}
+			hash, err := exec.Command("git", "-C", repoPath, "rev-list", "--max-count=1", tag).Output()
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve tag %s: %w", tag, err)
+			}
+			commits = append(commits, refCommit{Hash: strings.TrimSpace(string(hash)), Tag: tag})
+		}
+		return commits, nil
 	}
 
-	// Get the last 30 commit hashes
-	cmd := exec.Command("git", "-C", repoPath, "rev-list", fmt.Sprintf("--max-count=%d", cfg.BackLog), "origin/HEAD")
+	// Get the last BackLog commit hashes
+	cmd := exec.Command("git", "-C", repoPath, "rev-list", fmt.Sprintf("--max-count=%d", cfg.BackLog), "origin/"+ref.Name)
 	out, err := cmd.Output()
 	if err != nil {
-		fmt.Println("Failed to get commit list:", err)
-		return
+		return nil, fmt.Errorf("failed to get commit list: %w", err)
 	}
 
-	commits := strings.Split(strings.TrimSpace(string(out)), "\n")
-
-	for _, hash := range commits {
-		versionIdentifier := hash
-
+	for _, hash := range strings.Fields(string(out)) {
 		// Check if there is a tag for this commit
 		tagCmd := exec.Command("git", "-C", repoPath, "tag", "--points-at", hash)
 		tagOut, err := tagCmd.Output()
 		if err != nil {
-			fmt.Println("Failed to get tag for commit", hash, ":", err)
-			continue
+			return nil, fmt.Errorf("failed to get tag for commit %s: %w", hash, err)
 		}
-		tag := strings.TrimSpace(string(tagOut))
-		if tag != "" {
-			versionIdentifier = tag
+		tag, _, _ := strings.Cut(strings.TrimSpace(string(tagOut)), "\n")
+		commits = append(commits, refCommit{Hash: hash, Tag: tag})
+	}
+	return commits, nil
+}
+
+func processRef(cfg Config, repoPath string, game Game, ref *GameRef) ([]BuildJob, error) {
+	commits, err := listRefCommits(cfg, repoPath, *ref)
+	if err != nil || len(commits) == 0 {
+		return nil, err
+	}
+
+	var jobs []BuildJob
+	for i, c := range commits {
+		versionIdentifier := c.Hash
+		if c.Tag != "" {
+			versionIdentifier = c.Tag
 		}
 
 		// Check if this version already exists in the DB
-		var existing GameVersion
-		if err := DB.Where("version_hash = ?", "git:"+versionIdentifier).First(&existing).Error; err == nil {
+		var existing VersionAlias
+		if err := DB.Where("game_id = ? AND version_hash = ?", game.ID, "git:"+versionIdentifier).First(&existing).Error; err == nil {
+			if i == 0 {
+				ref.VersionID = &existing.GameVersionID
+			}
 			continue // version already exists
 		}
 
-		var istag bool = false
-
-		// Checkout the commit/tag
-		checkoutCmd := exec.Command("git", "-C", repoPath, "reset", "--hard", hash)
-		if tag != "" {
-			checkoutCmd = exec.Command("git", "-C", repoPath, "reset", "--hard", tag)
-			istag = true
-		}
-
-		if err := checkoutCmd.Run(); err != nil {
-			fmt.Println("Failed to checkout", versionIdentifier, ":", err)
+		// Pending or failed jobs are not requeued, failures are retried from the
+		// admin, and builds collected by gc are not rebuilt
+		var count int64
+		DB.Model(&BuildJob{}).Where("game_id = ? AND commit_hash = ? AND tag = ? AND state IN ?",
+			game.ID, c.Hash, c.Tag, []string{JobQueued, JobRunning, JobFailed, JobCollected}).Count(&count)
+		if count > 0 {
 			continue
 		}
 
-		progCmd := exec.Command("git", "-C", repoPath, "rev-list", "--count", "HEAD")
-		progOut, err := progCmd.Output()
-		if err != nil {
-			fmt.Println("Failed to get count for commit", hash, ":", err)
-			continue
+		job := BuildJob{
+			GameID:     game.ID,
+			GameRefID:  ref.ID,
+			CommitHash: c.Hash,
+			Tag:        c.Tag,
+			State:      JobQueued,
+		}
+		if err := DB.Create(&job).Error; err != nil {
+			return jobs, err
 		}
+		jobs = append(jobs, job)
+	}
 
-		scount := strings.TrimSpace(string(progOut))
+	// The rapid tag keeps pointing at the previous build until the new head is built
+	ref.Head = commits[0].Hash
+	DB.Save(ref)
 
-		prog, err := strconv.Atoi(scount)
+	return jobs, nil
+}
 
-		if err != nil {
-			fmt.Println("Failed to parse commit count for commit", hash, ":", scount, err.Error())
-			continue
-		}
+// runBuildJob checks out the commit of a job and creates its version. Progress
+// goes to jl so it ends up in the job log.
+func runBuildJob(cfg Config, job *BuildJob, jl *log.Logger) error {
+	var game Game
+	if err := DB.First(&game, job.GameID).Error; err != nil {
+		return fmt.Errorf("game %d not found: %w", job.GameID, err)
+	}
 
-		fmt.Printf("Prog is %d\n", prog)
+	repoPath := filepath.Join(cfg.ReposPath, game.ShortName)
+	hash := job.CommitHash
 
-		modinfo, err := os.Open(filepath.Join(repoPath, "modinfo.lua"))
-		fullname := game.ShortName + "-" + hash[:min(8, len(hash))]
-		if err == nil {
-			modinfocontent, _ := io.ReadAll(modinfo)
-			modinfo.Close()
-			var newmodinfo string = ""
-			if !istag {
-				newmodinfo = strings.ReplaceAll(string(modinfocontent), "$VERSION", fmt.Sprintf("test-%d-%s", prog, hash[:min(7, len(hash))]))
-			} else {
-				newmodinfo = strings.ReplaceAll(string(modinfocontent), "$VERSION", tag)
-			}
+	var ref GameRef
+	DB.First(&ref, job.GameRefID)
 
-			values, err := parseLuaTable(newmodinfo)
+	versionIdentifier := hash
+	var istag bool = false
+	if job.Tag != "" {
+		versionIdentifier = job.Tag
+		istag = true
+	}
 
-			if err != nil {
-				fmt.Println(err.Error())
-				continue
-			}
+	progCmd := exec.Command("git", "-C", repoPath, "rev-list", "--count", hash)
+	progOut, err := progCmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to get count for commit %s: %w", hash, err)
+	}
 
-			name, ok := values["name"]
-			version, ok2 := values["version"]
-			if ok && ok2 {
-				fullname = name + " " + version
-			}
+	scount := strings.TrimSpace(string(progOut))
 
-			out, _ := os.Create(filepath.Join(repoPath, "modinfo.lua"))
-			out.Write([]byte(newmodinfo))
-			out.Close()
+	prog, err := strconv.Atoi(scount)
 
-			log.Printf("Overridden version in modinfo\n")
-		}
+	if err != nil {
+		return fmt.Errorf("failed to parse commit count %q for commit %s: %w", scount, hash, err)
+	}
 
-		// Create the version
-		createVersion(repoPath, game, versionIdentifier, fullname, prog, cfg)
+	jl.Printf("Prog is %d\n", prog)
 
+	entries, err := listGitTree(repoPath, hash, jl)
+	if err != nil {
+		return err
 	}
-}
-func computeAndCreatePoolPath(cfg Config, md5sum string) string {
 
-	filep := filepath.Join(cfg.PoolPath, md5sum[0:2])
+	cf, err := newCatFile(repoPath)
+	if err != nil {
+		return err
+	}
+	defer cf.Close()
+
+	modversion := job.Tag
+	if !istag {
+		modversion = fmt.Sprintf("%s-%d-%s", ref.RapidTag(), prog, hash[:min(7, len(hash))])
+	}
 
-	if _, err := os.Stat(filep); os.IsNotExist(err) {
-		log.Printf("Creating pool path %s\n", filep)
+	fullname := game.ShortName + "-" + hash[:min(8, len(hash))]
+	mi, err := substituteModInfo(entries, cf, modversion, jl)
+	if err != nil {
+		return err
+	}
+	if mi != nil {
+		if name := mi.FullName(); name != "" {
+			fullname = name
+		}
 	}
 
-	err := os.MkdirAll(filep, 0750)
+	// Create the version
+	version, err := createVersion(game, "git:"+versionIdentifier, fullname, mi, entries, func() (blobReader, error) {
+		return newCatFile(repoPath)
+	}, cfg, jl)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	job.GameVersionID = &version.ID
 
-	return filepath.Join(filep, md5sum[2:]+".gz")
+	// Every ref whose head is this commit now resolves to the new version
+	DB.Model(&GameRef{}).Where("game_id = ? AND head = ?", game.ID, hash).Update("version_id", version.ID)
 
+	return nil
 }
 
 func CopyFile(src, dst string) (int64, error) {
@@ -245,147 +332,351 @@ func CopyFile(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
-func createVersion(repoPath string, game Game, hash string, fullname string, prog int, cfg Config) {
-	err := DB.Transaction(func(tx *gorm.DB) error {
+// createVersion hashes the entries into the pool and registers them as a
+// version of the game, aliased as aliasHash (e.g. git:<commit or tag>).
+// Content identical to an existing version only adds the alias.
+func createVersion(game Game, aliasHash string, fullname string, mi *ModInfo, entries []treeEntry, openBlobs func() (blobReader, error), cfg Config, jl *log.Logger) (*GameVersion, error) {
+	unlock, err := lockPool(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-		versionMD5 := md5sumString(hash) //TODO
+	return createVersionLocked(game, aliasHash, fullname, mi, entries, openBlobs, cfg, jl)
+}
 
-		version := GameVersion{
+// createVersionLocked is createVersion for callers already holding the pool
+// lock shared, e.g. to put objects into the pool before listing them.
+func createVersionLocked(game Game, aliasHash string, fullname string, mi *ModInfo, entries []treeEntry, openBlobs func() (blobReader, error), cfg Config, jl *log.Logger) (*GameVersion, error) {
+	known, err := knownBlobs(DB, entries)
+	if err != nil {
+		return nil, err
+	}
+	jl.Printf("%d of %d files known by blob\n", len(known), len(entries))
+	for _, e := range entries {
+		if e.File != nil {
+			known[e.key()] = *e.File
+		}
+	}
+
+	if err := checkEntrySizes(entries, jl); err != nil {
+		return nil, err
+	}
+
+	// Hash and compress the new files first, the transaction only inserts rows
+	hashed, err := hashEntries(cfg, entries, known, openBlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	var version GameVersion
+	err = DB.Transaction(func(tx *gorm.DB) error {
+
+		// Insert the new files and their blobs in bulk, then link every entry
+		var newFiles []File
+		var newBlobs []BlobFile
+		for _, e := range entries {
+			if _, ok := known[e.key()]; ok {
+				continue
+			}
+			sums := hashed[e.key()]
+			newFiles = append(newFiles, File{
+				MD5Sum:  sums.MD5hex,
+				CRC32:   sums.CRC32,
+				SHA256:  sums.SHA256hex,
+				Len:     uint64(sums.Len),
+				PoolLen: sums.PoolLen,
+			})
+		}
+		byMD5, err := insertFiles(tx, newFiles)
+		if err != nil {
+			return err
+		}
+
+		var files []VersionFile
+		var records []SdpRecord
+		paths := make(map[string]bool, len(entries))
+
+		for _, e := range entries {
+			if paths[e.Path] {
+				return fmt.Errorf("duplicate path %s, paths are case insensitive", e.Path)
+			}
+			if err := validSdpName(e.Path); err != nil {
+				return err
+			}
+			paths[e.Path] = true
+
+			file, ok := known[e.key()]
+			if !ok {
+				file = byMD5[hashed[e.key()].MD5hex]
+				if e.BlobSHA != "" && e.Content == nil {
+					newBlobs = append(newBlobs, BlobFile{BlobSHA: e.BlobSHA, FileID: file.ID})
+				}
+				known[e.key()] = file
+			}
+
+			if file.Len > sdpMaxSize || file.PoolLen > sdpMaxSize {
+				jl.Printf("%s is %d bytes, %d compressed, rapid sizes are limited to 4 GiB\n", e.Path, file.Len, file.PoolLen)
+				return fmt.Errorf("%s is too large for rapid", e.Path)
+			}
+
+			md5sum, _ := hex.DecodeString(file.MD5Sum)
+			files = append(files, VersionFile{
+				FileID: file.ID,
+				Path:   e.Path,
+			})
+			records = append(records, SdpRecord{
+				Filename: e.Path,
+				MD5:      [16]byte(md5sum),
+				CRC32:    file.CRC32,
+				Size:     uint32(file.Len),
+			})
+		}
+
+		if len(newBlobs) > 0 {
+			err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(newBlobs, insertBatchSize).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		versionMD5 := SdpMD5(records)
+		alias := VersionAlias{
+			GameID:      game.ID,
+			VersionHash: aliasHash,
+		}
+
+		// Identical trees share one package, the new build only gets an alias
+		if err := tx.Where("game_id = ? AND version_md5 = ?", game.ID, versionMD5).First(&version).Error; err == nil {
+			jl.Printf("Same content as %s (%s), adding alias\n", version.VersionHash, versionMD5)
+			alias.GameVersionID = version.ID
+			return tx.Create(&alias).Error
+		}
+
+		version = GameVersion{
 			GameID:      game.ID,
-			VersionHash: "git:" + hash,
+			VersionHash: alias.VersionHash,
 			VersionMD5:  versionMD5,
 			FullName:    fullname, //game.ShortName + "-" + hash[:min(7, len(hash))],
 			Published:   false,
 		}
+		if mi != nil {
+			version.ModName = mi.Name
+			version.ModShortName = mi.ShortName
+			version.ModVersion = mi.Version
+			version.Mutator = mi.Mutator
+			version.Description = mi.Description
+			for i, name := range mi.Depend {
+				version.Depends = append(version.Depends, VersionDepend{Position: i, Name: name})
+			}
+		}
 		if err := tx.Create(&version).Error; err != nil {
 			return err
 		}
 
-		err := filepath.Walk(repoPath, func(fullpath string, info os.FileInfo, err error) error {
-			if info == nil || info.IsDir() {
-				return nil
-			}
+		for i := range files {
+			files[i].GameVersionID = version.ID
+		}
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "game_version_id"}, {Name: "path"}},
+			DoNothing: true,
+		}).CreateInBatches(files, insertBatchSize).Error
+		if err != nil {
+			return err
+		}
+
+		alias.GameVersionID = version.ID
+		return tx.Create(&alias).Error
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed creating version: %w", err)
+	}
 
-			path, _ := filepath.Rel(repoPath, fullpath)
+	if _, err := os.Stat(packagePath(cfg, version.VersionMD5)); err != nil {
+		if err := writePackage(cfg, DB, version.VersionMD5); err != nil {
+			return nil, err
+		}
+	}
+
+	jl.Printf("Created version %s (%s)\n", version.FullName, version.VersionMD5)
+	return &version, nil
+}
 
-			path = strings.ToLower(path)
+// checkEntrySizes fails the build if any file exceeds what a package can
+// list, logging all of them so they can be fixed at once.
+func checkEntrySizes(entries []treeEntry, jl *log.Logger) error {
+	var large int
+	for _, e := range entries {
+		if e.Size > sdpMaxSize {
+			jl.Printf("%s is %d bytes, rapid sizes are limited to 4 GiB\n", e.Path, e.Size)
+			large++
+		}
+	}
+	if large > 0 {
+		return fmt.Errorf("%d files are too large for rapid", large)
+	}
+	return nil
+}
 
-			skip := false
+// hashEntries hashes and pools every entry that isn't known yet on a bounded
+// pool of workers, each with its own blob reader. Results are keyed by
+// treeEntry.key so a blob used by several paths is only read once.
+func hashEntries(cfg Config, entries []treeEntry, known map[string]File, openBlobs func() (blobReader, error)) (map[string]*FileChecksums, error) {
+	var todo []treeEntry
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if _, ok := known[e.key()]; ok || seen[e.key()] {
+			continue
+		}
+		seen[e.key()] = true
+		todo = append(todo, e)
+	}
 
-			if strings.HasPrefix(path, ".git") {
-				skip = true
-			}
+	hashed := make(map[string]*FileChecksums, len(todo))
+	if len(todo) == 0 {
+		return hashed, nil
+	}
 
-			if !skip {
+	workers := cfg.BuildParallelism
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	workers = max(1, min(workers, len(todo)))
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan treeEntry)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			br, err := openBlobs()
+			if err == nil {
+				defer br.Close()
+			}
 
-				sums, err := FileSums(fullpath)
+			for e := range queue {
 				if err != nil {
-					return err
-				}
-
-				var file File
-				if err := tx.Where("md5_sum = ?", sums.MD5hex).First(&file).Error; err != nil {
-
-					file = File{
-
-						MD5Sum: sums.MD5hex,
-						CRC32:  sums.CRC32,
-						Len:    uint64(info.Size()),
-					}
-					res := tx.Create(&file)
-					if res.Error != nil {
-						return res.Error
-					}
-
-					pp := computeAndCreatePoolPath(cfg, sums.MD5hex)
-					if _, err := os.Stat(pp); os.IsNotExist(err) {
-						//_, err = CopyFile(fullpath, pp)
-						dest, err := os.Create(pp)
-						if err != nil {
-							log.Println(err.Error())
-							return err
-						}
-						gzw := gzip.NewWriter(dest)
-						src, err := os.Open(fullpath)
-						if err != nil {
-							dest.Close()
-							os.Remove(pp)
-							log.Println(err.Error())
-							return err
-						}
-
-						defer dest.Close()
-						defer src.Close()
-
-						_, err = io.Copy(gzw, src)
-
-						gzw.Flush()
-						gzw.Close()
-
-						if err != nil {
-							log.Println(err.Error())
-							return err
-						}
-					}
+					continue
 				}
 
-				vf := VersionFile{
-					GameVersionID: version.ID,
-					FileID:        file.ID,
-					Path:          path,
+				var sums *FileChecksums
+				err = e.read(br, func(r io.Reader) error {
+					var err error
+					sums, err = HashToPool(cfg, r, "")
+					return err
+				})
+				if err != nil {
+					err = fmt.Errorf("%s: %w", e.Path, err)
+					continue
 				}
-				tx.Create(&vf)
 
+				mu.Lock()
+				hashed[e.key()] = sums
+				mu.Unlock()
 			}
 
-			return nil
-		})
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
-		newMD5 := GetSDPMD5(tx, versionMD5)
-		log.Printf("MD5 %s -> %s\n", versionMD5, newMD5)
+	for _, e := range todo {
+		queue <- e
+	}
+	close(queue)
+	wg.Wait()
 
-		version.VersionMD5 = newMD5
-		tx.Save(&version)
+	return hashed, firstErr
+}
 
-		return err
-	})
+// Rows per INSERT, well below the postgres limit of 65535 parameters
+const insertBatchSize = 1000
 
-	if err != nil {
-		log.Println("Failed creating version:", err)
-		return
+// insertFiles inserts the files whose md5 isn't known yet, refreshes the pool
+// size of the others and returns all of them by md5 with their ids. Concurrent builds of the same file are resolved
+// by the unique md5 index.
+func insertFiles(tx *gorm.DB, files []File) (map[string]File, error) {
+	byMD5 := make(map[string]File, len(files))
+	if len(files) == 0 {
+		return byMD5, nil
 	}
 
-}
-
-type FileChecksums struct {
-	MD5hex string
-	MD5    [16]byte
-	CRC32  uint32
-}
+	unique := make([]File, 0, len(files))
+	for _, f := range files {
+		if _, ok := byMD5[f.MD5Sum]; !ok {
+			byMD5[f.MD5Sum] = f
+			unique = append(unique, f)
+		}
+	}
 
-func FileSums(path string) (*FileChecksums, error) {
-	f, err := os.Open(path)
+	// The pool object was just written, its size replaces the cached one
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "md5_sum"}},
+		DoUpdates: clause.AssignmentColumns([]string{"pool_len"}),
+	}).CreateInBatches(unique, insertBatchSize).Error
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	h := md5.New()
-	io.Copy(h, f)
 
-	ret := FileChecksums{}
-	ret.MD5 = [16]byte(h.Sum(nil))
-	ret.MD5hex = hex.EncodeToString(ret.MD5[:])
-	C := crc32.New(crc32.IEEETable)
-	f.Seek(0, io.SeekStart)
-	io.Copy(C, f)
-	ret.CRC32 = C.Sum32()
+	// Conflicting rows aren't returned, read back every id
+	for start := 0; start < len(unique); start += insertBatchSize {
+		md5s := make([]string, 0, insertBatchSize)
+		for _, f := range unique[start:min(start+insertBatchSize, len(unique))] {
+			md5s = append(md5s, f.MD5Sum)
+		}
 
-	return &ret, nil
+		var rows []File
+		if err := tx.Where("md5_sum IN ?", md5s).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, f := range rows {
+			byMD5[f.MD5Sum] = f
+		}
+	}
+	return byMD5, nil
 }
 
-func md5sumString(s string) string {
-	h := md5.New()
-	h.Write([]byte(s))
-	return hex.EncodeToString(h.Sum(nil))
+// knownBlobs returns the File of every entry whose git blob was hashed by an
+// earlier build.
+func knownBlobs(tx *gorm.DB, entries []treeEntry) (map[string]File, error) {
+	shas := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.BlobSHA != "" && e.Content == nil {
+			shas = append(shas, e.BlobSHA)
+		}
+	}
+
+	known := make(map[string]File, len(shas))
+	for start := 0; start < len(shas); start += 1000 {
+		chunk := shas[start:min(start+1000, len(shas))]
+
+		var rows []struct {
+			BlobSHA string
+			File
+		}
+		err := tx.Table("blob_files").
+			Select("blob_files.blob_sha, files.*").
+			Joins("INNER JOIN files ON files.id = blob_files.file_id").
+			Where("blob_files.blob_sha IN ?", chunk).
+			Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			known[r.BlobSHA] = r.File
+		}
+	}
+	return known, nil
 }
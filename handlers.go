@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
-	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gin-contrib/sessions"
@@ -24,15 +29,37 @@ func ReposHandler(c *gin.Context) {
 	gz := gzip.NewWriter(c.Writer)
 	defer gz.Close()
 
+	var mirrors []Mirror
+	DB.Where("enabled = true AND healthy = true").Order("priority, id").Find(&mirrors)
+
+	WriteRepos(gz, func(g Game) []string {
+		urls := []string{g.RepoURL}
+		for _, m := range mirrors {
+			if m.GameID == nil || *m.GameID == g.ID {
+				urls = append(urls, m.GameURL(g))
+			}
+		}
+		return urls
+	})
+	gz.Flush()
+	gz.Close()
+}
+
+// WriteRepos writes the uncompressed repos.gz listing, repoURLs gives the
+// base URLs advertised for each game, one line each.
+func WriteRepos(w io.Writer, repoURLs func(Game) []string) error {
 	var games []Game
-	DB.Find(&games)
+	DB.Order("short_name").Find(&games)
 
 	for _, g := range games {
-		line := fmt.Sprintf("%s,%s,,\n", g.ShortName, g.RepoURL)
-		gz.Write([]byte(line))
+		for _, u := range repoURLs(g) {
+			line := fmt.Sprintf("%s,%s,,\n", g.ShortName, u)
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
 	}
-	gz.Flush()
-	gz.Close()
+	return nil
 }
 
 func VersionsHandler(c *gin.Context) {
@@ -44,68 +71,102 @@ func VersionsHandler(c *gin.Context) {
 		return
 	}
 
-	var versions []GameVersion
-	DB.Where("game_id = ?", game.ID).Order("id DESC").Limit(100).Find(&versions)
+	//Render first so a database error can still become a 500
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := WriteVersions(gz, game); err != nil {
+		log.Printf("versions.gz of %s: %s\n", shortname, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	gz.Close()
 
-	c.Header("Content-Type", "application/gzip")
+	c.Data(http.StatusOK, "application/gzip", buf.Bytes())
+}
 
-	gz := gzip.NewWriter(c.Writer)
-	defer gz.Close()
+// WriteVersions writes the uncompressed versions.gz listing of a game.
+func WriteVersions(w io.Writer, game Game) error {
+	shortname := game.ShortName
 
-	var lastver *GameVersion = nil
-	
+	var lines []string
 
-	for _, v := range versions {
-		line := fmt.Sprintf("%s:%s,%s,,%s\n",
+	var aliases []VersionAlias
+	err := DB.Preload("GameVersion.Depends", orderDepends).Where("game_id = ?", game.ID).Order("id DESC").Limit(100).Find(&aliases).Error
+	if err != nil {
+		return err
+	}
+
+	for _, a := range aliases {
+		v := a.GameVersion
+		lines = append(lines, fmt.Sprintf("%s:%s,%s,%s,%s\n",
 			shortname,
-			v.VersionHash,
+			a.VersionHash,
 			v.VersionMD5,
+			v.DependsColumn(),
 			v.FullName,
-		)
-		gz.Write([]byte(line))
-		lastver = &v
-	}
-
-	//We tag as test all git versions, so last one is latest 
-	line := fmt.Sprintf("%s:test,%s,,%s\n",
-		shortname,
-		lastver.VersionMD5,
-		lastver.FullName,
-	)
-	gz.Write([]byte(line))
-
-	//We tag published as stable
-	var g GameVersion
-	if DB.Where("game_id = ? AND published = true", game.ID).Order("id DESC").First(&g).Error == nil {
-		line := fmt.Sprintf("%s:stable,%s,,%s\n",
-		shortname,
-		g.VersionMD5,
-		g.FullName)
-		gz.Write([]byte(line))
+		))
 	}
-	gz.Flush()
-	gz.Close()
-}
 
-func GetSDPRecords(tx *gorm.DB, md5 string) ([]SdpRecord, error) {
-	var version GameVersion
-	if err := tx.Where("version_md5 = ?", md5).First(&version).Error; err != nil {
-
-		return make([]SdpRecord, 0), fmt.Errorf("Version not found")
+	//Every tracked ref points at the newest version built from it
+	var refs []GameRef
+	err = DB.Preload("Version.Depends", orderDepends).Where("game_id = ? AND version_id IS NOT NULL", game.ID).Order("id").Find(&refs).Error
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if r.Version == nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s:%s,%s,%s,%s\n",
+			shortname,
+			r.RapidTag(),
+			r.Version.VersionMD5,
+			r.Version.DependsColumn(),
+			r.Version.FullName,
+		))
 	}
 
-	records := make([]SdpRecord, 0)
-
-	var files []FileP
+	//Channels are pinned or follow their rule
+	var channels []Channel
+	if err := DB.Where("game_id = ?", game.ID).Order("name").Find(&channels).Error; err != nil {
+		return err
+	}
+	for _, ch := range channels {
+		v, err := ch.Resolve(DB)
+		if err != nil {
+			return fmt.Errorf("channel %s: %w", ch.Name, err)
+		}
+		if v == nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s:%s,%s,%s,%s\n",
+			shortname,
+			ch.Name,
+			v.VersionMD5,
+			v.DependsColumn(),
+			v.FullName))
+	}
 
-	err := tx.Table("version_files").Select("* , files.*").Joins("INNER JOIN files ON version_files.file_id = files.id").Where("version_files.game_version_id = ?", version.ID).Order("files.crc32").Scan(&files).Error
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func GetSDPRecords(tx *gorm.DB, md5 string) ([]SdpRecord, error) {
+	files, err := versionFiles(tx, md5)
 	if err != nil {
-		log.Println(err.Error())
-		return make([]SdpRecord, 0), fmt.Errorf("Version corrupted: %s", err.Error())
+		return make([]SdpRecord, 0), err
 	}
 
+	records := make([]SdpRecord, 0, len(files))
 	for _, vf := range files {
+		// Builds refuse such files, never publish a truncated size
+		if vf.Len > sdpMaxSize {
+			return make([]SdpRecord, 0), fmt.Errorf("Version corrupted: %s is %d bytes", vf.Path, vf.Len)
+		}
 		h, _ := hex.DecodeString(vf.MD5Sum)
 		records = append(records, SdpRecord{
 			Filename: vf.Path,
@@ -118,43 +179,79 @@ func GetSDPRecords(tx *gorm.DB, md5 string) ([]SdpRecord, error) {
 
 }
 
-func GetSDPMD5(tx *gorm.DB, h string) string {
-	records, _ := GetSDPRecords(tx, h)
-	md5hash := md5.New()
-	for _, r := range records {
-		nameMd5 := md5.New()
-		nameMd5.Write([]byte(r.Filename))
-		h1 := nameMd5.Sum(nil)
-		md5hash.Write(h1)
-		md5hash.Write(r.MD5[:])
-	}
+var errVersionNotFound = errors.New("Version not found")
 
-	//WriteAllFileRecords(md5hash, records)
-	return hex.EncodeToString(md5hash.Sum(nil))
-}
-
-func PackageHandler(c *gin.Context) {
-	//shortname := c.Param("shortname")
-
-	filename := c.Param("filename")
+// versionFiles returns the files of a package in .sdp order, the order
+// streamer.cgi bitmasks refer to.
+func versionFiles(tx *gorm.DB, md5 string) ([]FileP, error) {
+	var version GameVersion
+	if err := tx.Where("version_md5 = ?", md5).First(&version).Error; err != nil {
+		return nil, errVersionNotFound
+	}
 
-	x := strings.Split(filename, ".")
+	var files []FileP
+	err := tx.Table("version_files").
+		Select("files.id, files.md5_sum, files.crc32, files.len, files.pool_len, version_files.path").
+		Joins("INNER JOIN files ON version_files.file_id = files.id").
+		Where("version_files.game_version_id = ?", version.ID).
+		Scan(&files).Error
+	if err != nil {
+		log.Println(err.Error())
+		return nil, fmt.Errorf("Version corrupted: %s", err.Error())
+	}
 
-	records, err := GetSDPRecords(DB, x[0])
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CRC32 != files[j].CRC32 {
+			return files[i].CRC32 < files[j].CRC32
+		}
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
 
-	c.Header("Content-Type", "application/octet-stream")
+var packageName = regexp.MustCompile(`^([0-9a-f]{32})\.sdp$`)
 
-	gz := gzip.NewWriter(c.Writer)
-	defer gz.Close()
+// PackageHandler serves the .sdp cached under PoolPath/packages, only falling
+// back to the database when the cached file is missing.
+func PackageHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m := packageName.FindStringSubmatch(c.Param("filename"))
+		if m == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		md5sum := m[1]
+
+		fp := packagePath(cfg, md5sum)
+		f, err := os.Open(fp)
+		if os.IsNotExist(err) {
+			if err := writePackage(cfg, DB, md5sum); err != nil {
+				log.Println(err.Error())
+				c.Status(http.StatusNotFound)
+				return
+			}
+			f, err = os.Open(fp)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
 
-	err = WriteAllFileRecords(gz, records)
+		st, err := f.Stat()
+		if err != nil {
+			log.Println(err.Error())
+			c.Status(http.StatusInternalServerError)
+			return
+		}
 
-	if err != nil {
-		log.Println(err.Error())
-		//c.Status(http.StatusInternalServerError)
-		return
+		// Packages are content addressed, the name never changes meaning
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("ETag", `"`+md5sum+`"`)
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(c.Writer, c.Request, md5sum+".sdp", st.ModTime(), f)
 	}
-
 }
 
 func GetBit(data []byte, bitIndex int) bool {
@@ -168,66 +265,112 @@ func GetBit(data []byte, bitIndex int) bool {
 	return (data[byteIndex] & (1 << bitPos)) != 0
 }
 
+// StreamerHandler implements streamer.cgi?<package md5>. The body is a
+// gzipped bitmask over the files of the package, the response has the 4 byte
+// big-endian size and the gzipped pool object of each selected file. Every
+// selected object is checked before the headers go out, so a missing one
+// fails the request with an error status instead of a cut transfer.
 func StreamerHandler(c *gin.Context) {
-	cfg, _ := LoadConfig()
-	records, err := GetSDPRecords(DB, c.Request.URL.RawQuery)
+	files, err := versionFiles(DB, c.Request.URL.RawQuery)
+	if errors.Is(err, errVersionNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Println(err.Error())
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 
-	rdr, _ := gzip.NewReader(c.Request.Body)
+	rdr, err := gzip.NewReader(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid request: %s", err)
+		return
+	}
 	defer rdr.Close()
 
 	req, err := io.ReadAll(rdr)
-
 	if err != nil {
-		log.Println(err.Error())
-		c.Status(http.StatusInternalServerError)
+		c.String(http.StatusBadRequest, "invalid request: %s", err)
 		return
 	}
-	totallen := 0
-	for index, r := range records {
-		if GetBit(req, index) {
-			fp := computeAndCreatePoolPath(cfg, hex.EncodeToString(r.MD5[:]))
-			st, err := os.Stat(fp)
+
+	var selected []FileP
+	var totallen int64
+	for index, f := range files {
+		if !GetBit(req, index) {
+			continue
+		}
+
+		// Sizes come from the files table, only files built before sizes were
+		// cached and objects verify-pool found broken have to be looked up
+		if f.PoolLen == 0 {
+			size, err := pool.Stat(f.MD5Sum)
 			if err != nil {
-				panic(err)
+				log.Printf("Pool object %s of %s: %s\n", f.MD5Sum, f.Path, err)
+				if errors.Is(err, os.ErrNotExist) {
+					c.Status(http.StatusNotFound)
+				} else {
+					c.Status(http.StatusInternalServerError)
+				}
+				return
 			}
-			totallen += int(st.Size()) + 4
+			f.PoolLen = size
+			DB.Model(&File{}).Where("id = ?", f.ID).Update("pool_len", size)
+		}
+		if f.PoolLen > sdpMaxSize {
+			log.Printf("Pool object %s of %s is too large to stream\n", f.MD5Sum, f.Path)
+			c.Status(http.StatusInternalServerError)
+			return
 		}
+
+		selected = append(selected, f)
+		totallen += 4 + f.PoolLen
 	}
-	//indexes := make([]uint16, 0)
-	c.Header("Content-Length", fmt.Sprintf("%d", totallen))
+
+	c.Header("Content-Length", strconv.FormatInt(totallen, 10))
 	c.Header("Content-Transfer-Encoding", "binary")
 	c.Header("Content-Type", "application/octet-stream")
 	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
 
-	c.Stream(func(w io.Writer) bool {
-		for index, r := range records {
-			if GetBit(req, index) {
-				fp := computeAndCreatePoolPath(cfg, hex.EncodeToString(r.MD5[:]))
-				st, err := os.Stat(fp)
-				if err != nil {
-					panic(err)
-				}
-				srcfile, err := os.Open(fp)
-				if err != nil {
-					panic(err)
-				}
-				defer srcfile.Close()
-				var s uint32 = uint32(st.Size())
-				binary.Write(w, binary.BigEndian, &s)
-				io.Copy(w, srcfile)
-				//log.Printf("Streaming %s %d\n", fp, st.Size())
-			}
+	// The net/http writer copies *os.File with sendfile, gin's wrapper doesn't
+	var w io.Writer = c.Writer
+	if u, ok := c.Writer.(interface{ Unwrap() http.ResponseWriter }); ok {
+		w = u.Unwrap()
+	}
 
+	for _, f := range selected {
+		if err := streamPoolObject(w, f); err != nil {
+			// Objects gone or changed since their size was cached, or I/O
+			// failures. The length is already sent, cut the connection so the
+			// client sees a failed transfer instead of a short one
+			log.Printf("Failed streaming %s of %s: %s\n", f.MD5Sum, f.Path, err)
+			panic(http.ErrAbortHandler)
 		}
-		return false
-	})
+	}
+}
+
+func streamPoolObject(w io.Writer, f FileP) error {
+	r, err := pool.Open(f.MD5Sum)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(f.PoolLen))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
 
-	//fmt.Println(indexes)
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != f.PoolLen {
+		return fmt.Errorf("object is %d bytes, expected %d", n, f.PoolLen)
+	}
+	return nil
 }
 
 func CreateGame(c *gin.Context) {
@@ -236,9 +379,57 @@ func CreateGame(c *gin.Context) {
 	game.ShortName = c.PostForm("short_name")
 	game.RepoURL = c.PostForm("repo_url")
 	game.GitURL = c.PostForm("git_url")
+	game.WebhookSecret = c.PostForm("webhook_secret")
+	game.UploadToken = c.PostForm("upload_token")
+	game.KeepBuilds, _ = strconv.Atoi(c.PostForm("keep_builds"))
+
+	if err := DB.Create(&game).Error; err == nil {
+		ref := DefaultRef(game.ID)
+		DB.Create(&ref)
+		ch := DefaultChannel(game.ID)
+		DB.Create(&ch)
+	}
+
+	c.Redirect(http.StatusFound, "/admin/games")
+}
+
+func ShowEditGame(c *gin.Context) {
+	var game Game
+	if err := DB.First(&game, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.HTML(http.StatusOK, "edit_game.html", gin.H{
+		"game": game,
+	})
+}
+
+// UpdateGame sets the webhook secret and upload token, empty disables them.
+func UpdateGame(c *gin.Context) {
+	var game Game
+	if err := DB.First(&game, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	DB.Model(&game).Updates(map[string]interface{}{
+		"webhook_secret": strings.TrimSpace(c.PostForm("webhook_secret")),
+		"upload_token":   strings.TrimSpace(c.PostForm("upload_token")),
+	})
 
-	DB.Create(&game)
+	c.Redirect(http.StatusFound, "/admin/games")
+}
+
+// UpdateRetention sets how many test builds of a game gc keeps.
+func UpdateRetention(c *gin.Context) {
+	keep, err := strconv.Atoi(c.PostForm("keep_builds"))
+	if err != nil || keep < 0 {
+		c.String(http.StatusBadRequest, "invalid number of builds")
+		return
+	}
 
+	DB.Model(&Game{}).Where("id = ?", c.Param("id")).Update("keep_builds", keep)
 	c.Redirect(http.StatusFound, "/admin/games")
 }
 
@@ -246,12 +437,21 @@ func ListVersions(c *gin.Context) {
 	id := c.Param("id")
 
 	var game Game
+	DB.First(&game, id)
 	var versions []GameVersion
-	DB.Where("game_id = ?", id).Order("ID desc").Find(&versions)
+	DB.Preload("Aliases").Where("game_id = ?", id).Order("ID desc").Find(&versions)
+
+	var mirrors []Mirror
+	DB.Where("enabled = true AND healthy = true AND (game_id IS NULL OR game_id = ?)", id).Order("priority, id").Find(&mirrors)
+	mirrorURLs := make([]string, 0, len(mirrors))
+	for _, m := range mirrors {
+		mirrorURLs = append(mirrorURLs, m.GameURL(game))
+	}
 
 	c.HTML(http.StatusOK, "versions.html", gin.H{
-		"game": game,
+		"game":     game,
 		"versions": versions,
+		"mirrors":  mirrorURLs,
 	})
 }
 
@@ -259,8 +459,8 @@ func TogglePublishVersion(c *gin.Context) {
 	id := c.Param("id")
 
 	DB.Model(&GameVersion{}).
-    Where("id = ?", id).
-    Update("published", gorm.Expr("NOT published"))
+		Where("id = ?", id).
+		Update("published", gorm.Expr("NOT published"))
 
 	c.Redirect(http.StatusFound, c.Request.Referer())
 }
@@ -344,3 +544,313 @@ func Dashboard(c *gin.Context) {
 func ShowNewGame(c *gin.Context) {
 	c.HTML(http.StatusOK, "new_game.html", nil)
 }
+
+func ListJobs(c *gin.Context) {
+	var jobs []BuildJob
+	q := DB.Preload("Game").Order("id desc").Limit(200)
+	if state := c.Query("state"); state != "" {
+		q = q.Where("state = ?", state)
+	}
+	q.Find(&jobs)
+
+	c.HTML(http.StatusOK, "jobs.html", gin.H{
+		"jobs":  jobs,
+		"state": c.Query("state"),
+	})
+}
+
+func ShowJob(c *gin.Context) {
+	var job BuildJob
+	if err := DB.Preload("Game").First(&job, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.HTML(http.StatusOK, "job.html", gin.H{
+		"job": job,
+	})
+}
+
+func RetryJob(c *gin.Context) {
+	var job BuildJob
+	if err := DB.First(&job, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if job.State == JobFailed {
+		job.State = JobQueued
+		job.Error = ""
+		job.Log = ""
+		job.StartedAt = nil
+		job.FinishedAt = nil
+		DB.Save(&job)
+		builder.Enqueue(job)
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/admin/jobs/%d", job.ID))
+}
+
+func ListRefs(c *gin.Context) {
+	var game Game
+	if err := DB.Preload("Refs", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Preload("Refs.Version").First(&game, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.HTML(http.StatusOK, "refs.html", gin.H{
+		"game":  game,
+		"error": c.Query("error"),
+	})
+}
+
+func CreateRef(c *gin.Context) {
+	var game Game
+	if err := DB.First(&game, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	ref := GameRef{
+		GameID: game.ID,
+		Kind:   c.PostForm("kind"),
+		Name:   strings.TrimSpace(c.PostForm("name")),
+		Tag:    strings.TrimSpace(c.PostForm("tag")),
+	}
+
+	redirect := fmt.Sprintf("/admin/games/%d/refs", game.ID)
+	if ref.Kind != RefBranch && ref.Kind != RefTag {
+		c.Redirect(http.StatusFound, redirect+"?error=invalid+kind")
+		return
+	}
+	// Names end up as git arguments
+	if ref.Name == "" || strings.HasPrefix(ref.Name, "-") || ref.Tag == "" || strings.ContainsAny(ref.Tag, ",:\n") {
+		c.Redirect(http.StatusFound, redirect+"?error=invalid+name+or+tag")
+		return
+	}
+	taken, err := channelTaken(DB, game.ID, ref.Tag)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		c.Redirect(http.StatusFound, redirect+"?error=tag+is+used+by+a+channel")
+		return
+	}
+
+	DB.Create(&ref)
+	EnqueueGame(game.ID)
+
+	c.Redirect(http.StatusFound, redirect)
+}
+
+func DeleteRef(c *gin.Context) {
+	var ref GameRef
+	if err := DB.First(&ref, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	DB.Delete(&ref)
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/admin/games/%d/refs", ref.GameID))
+}
+
+type channelRow struct {
+	Channel
+	PinnedID uint
+	Current  *GameVersion
+	Error    string
+}
+
+func ListChannels(c *gin.Context) {
+	var game Game
+	if err := DB.First(&game, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	var channels []Channel
+	DB.Where("game_id = ?", game.ID).Order("name").Find(&channels)
+
+	rows := make([]channelRow, 0, len(channels))
+	for _, ch := range channels {
+		row := channelRow{Channel: ch}
+		if ch.VersionID != nil {
+			row.PinnedID = *ch.VersionID
+		}
+		v, err := ch.Resolve(DB)
+		if err != nil {
+			row.Error = err.Error()
+		}
+		row.Current = v
+		rows = append(rows, row)
+	}
+
+	var versions []GameVersion
+	DB.Where("game_id = ?", game.ID).Order("id DESC").Limit(100).Find(&versions)
+
+	c.HTML(http.StatusOK, "channels.html", gin.H{
+		"game":     game,
+		"channels": rows,
+		"versions": versions,
+		"error":    c.Query("error"),
+	})
+}
+
+// channelFromForm fills the pin and rule of a channel from the posted form.
+func channelFromForm(c *gin.Context, ch *Channel) error {
+	ch.VersionID = nil
+	if pin := c.PostForm("version_id"); pin != "" {
+		var v GameVersion
+		if err := DB.Where("game_id = ?", ch.GameID).First(&v, pin).Error; err != nil {
+			return fmt.Errorf("unknown version")
+		}
+		ch.VersionID = &v.ID
+	}
+
+	ch.PublishedOnly = c.PostForm("published_only") != ""
+	ch.Match = strings.TrimSpace(c.PostForm("match"))
+	if _, err := regexp.Compile(ch.Match); err != nil {
+		return fmt.Errorf("invalid match: %w", err)
+	}
+	return nil
+}
+
+func CreateChannel(c *gin.Context) {
+	var game Game
+	if err := DB.First(&game, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	redirect := fmt.Sprintf("/admin/games/%d/channels", game.ID)
+
+	ch := Channel{
+		GameID: game.ID,
+		Name:   strings.TrimSpace(c.PostForm("name")),
+	}
+	if ch.Name == "" || strings.ContainsAny(ch.Name, ",:\n") {
+		c.Redirect(http.StatusFound, redirect+"?error=invalid+name")
+		return
+	}
+	taken, err := refTagTaken(DB, game.ID, ch.Name)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		c.Redirect(http.StatusFound, redirect+"?error=name+is+used+by+a+ref")
+		return
+	}
+	if err := channelFromForm(c, &ch); err != nil {
+		c.Redirect(http.StatusFound, redirect+"?error="+url.QueryEscape(err.Error()))
+		return
+	}
+	if err := DB.Create(&ch).Error; err != nil {
+		c.Redirect(http.StatusFound, redirect+"?error=channel+already+exists")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirect)
+}
+
+func UpdateChannel(c *gin.Context) {
+	var ch Channel
+	if err := DB.First(&ch, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	redirect := fmt.Sprintf("/admin/games/%d/channels", ch.GameID)
+
+	if err := channelFromForm(c, &ch); err != nil {
+		c.Redirect(http.StatusFound, redirect+"?error="+url.QueryEscape(err.Error()))
+		return
+	}
+	DB.Save(&ch)
+
+	c.Redirect(http.StatusFound, redirect)
+}
+
+func DeleteChannel(c *gin.Context) {
+	var ch Channel
+	if err := DB.First(&ch, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	DB.Delete(&ch)
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/admin/games/%d/channels", ch.GameID))
+}
+
+func ListMirrors(c *gin.Context) {
+	var mirrors []Mirror
+	DB.Preload("Game").Order("priority, id").Find(&mirrors)
+
+	var games []Game
+	DB.Order("short_name").Find(&games)
+
+	c.HTML(http.StatusOK, "mirrors.html", gin.H{
+		"mirrors": mirrors,
+		"games":   games,
+		"error":   c.Query("error"),
+	})
+}
+
+func CreateMirror(c *gin.Context) {
+	m := Mirror{
+		BaseURL: strings.TrimSuffix(strings.TrimSpace(c.PostForm("base_url")), "/"),
+		Region:  strings.TrimSpace(c.PostForm("region")),
+		Enabled: true,
+	}
+	m.Priority, _ = strconv.Atoi(c.PostForm("priority"))
+
+	if u, err := url.Parse(m.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.Redirect(http.StatusFound, "/admin/mirrors?error=invalid+base+url")
+		return
+	}
+
+	if gameID := c.PostForm("game_id"); gameID != "" {
+		var game Game
+		if err := DB.First(&game, gameID).Error; err != nil {
+			c.Redirect(http.StatusFound, "/admin/mirrors?error=unknown+game")
+			return
+		}
+		m.GameID = &game.ID
+	}
+
+	DB.Create(&m)
+	EnqueueMirrorCheck(m.ID)
+
+	c.Redirect(http.StatusFound, "/admin/mirrors")
+}
+
+func ToggleMirror(c *gin.Context) {
+	DB.Model(&Mirror{}).
+		Where("id = ?", c.Param("id")).
+		Update("enabled", gorm.Expr("NOT enabled"))
+
+	c.Redirect(http.StatusFound, "/admin/mirrors")
+}
+
+func CheckMirrorNow(c *gin.Context) {
+	var m Mirror
+	if err := DB.First(&m, c.Param("id")).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	EnqueueMirrorCheck(m.ID)
+
+	c.Redirect(http.StatusFound, "/admin/mirrors")
+}
+
+func DeleteMirror(c *gin.Context) {
+	DB.Delete(&Mirror{}, c.Param("id"))
+
+	c.Redirect(http.StatusFound, "/admin/mirrors")
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func runImport(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	versions := fs.String("versions", "", "path or URL of the versions.gz to import")
+	packages := fs.String("packages", "", "directory or URL holding the <md5>.sdp files (defaults to packages/ next to versions.gz)")
+	poolDir := fs.String("pool", "", "local pool directory with the xx/rest.gz objects")
+	shortname := fs.String("game", "", "only import the versions of this game")
+	repoURL := fs.String("repo-url", "", "repo URL of the game if it has to be created")
+	copyOnly := fs.Bool("copy", false, "copy pool objects instead of hard-linking them")
+	fs.Parse(args)
+
+	if *versions == "" || *poolDir == "" {
+		return errors.New("import: --versions and --pool are required")
+	}
+	if *packages == "" {
+		if isURL(*versions) {
+			*packages = (*versions)[:strings.LastIndex(*versions, "/")+1] + "packages"
+		} else {
+			*packages = filepath.Join(filepath.Dir(*versions), "packages")
+		}
+	}
+
+	im := importer{
+		cfg:      cfg,
+		packages: strings.TrimSuffix(*packages, "/"),
+		pool:     *poolDir,
+		repoURL:  *repoURL,
+		copyOnly: *copyOnly,
+	}
+	if err := im.run(*versions, *shortname); err != nil {
+		return err
+	}
+
+	log.Printf("Import done: %d versions, %d aliases, %d pool objects, %d failed\n",
+		im.versions, im.aliases, im.objects, im.failed)
+	if im.failed > 0 {
+		return fmt.Errorf("import: %d versions failed", im.failed)
+	}
+	return nil
+}
+
+// versionLine is one line of a versions.gz: <shortname>:<tag>,<package
+// md5>,<depends>,<full name>.
+type versionLine struct {
+	ShortName string
+	Tag       string
+	MD5       string
+	Depends   []string
+	FullName  string
+}
+
+func parseVersionLine(line string) (versionLine, error) {
+	cols := strings.SplitN(line, ",", 4)
+	if len(cols) != 4 {
+		return versionLine{}, fmt.Errorf("invalid versions.gz line %q", line)
+	}
+	short, tag, ok := strings.Cut(cols[0], ":")
+	if !ok || short == "" || tag == "" {
+		return versionLine{}, fmt.Errorf("invalid tag %q", cols[0])
+	}
+	if !md5Hex.MatchString(cols[1]) {
+		return versionLine{}, fmt.Errorf("invalid package md5 %q", cols[1])
+	}
+
+	v := versionLine{ShortName: short, Tag: tag, MD5: cols[1], FullName: cols[3]}
+	if cols[2] != "" {
+		v.Depends = strings.Split(cols[2], "|")
+	}
+	return v, nil
+}
+
+// importer adopts the versions of an existing rapid repository, the pool
+// objects they list are verified against the .sdp before entering the pool.
+type importer struct {
+	cfg      Config
+	packages string
+	pool     string
+	repoURL  string
+	copyOnly bool
+	// gameURL is set to replicate an upstream game, objects are downloaded
+	// from its streamer.cgi, or poolURL, instead of the local pool
+	gameURL string
+	poolURL string
+
+	games map[string]Game
+
+	versions int
+	aliases  int
+	objects  int
+	failed   int
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// openSource reads a local file or downloads a URL.
+func openSource(src string) (io.ReadCloser, error) {
+	if !isURL(src) {
+		return os.Open(src)
+	}
+
+	resp, err := mirrorClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// readGzipLines returns the lines of a gzipped listing such as versions.gz.
+func readGzipLines(src string) ([]string, error) {
+	r, err := openSource(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	defer gz.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(gz)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return lines, nil
+}
+
+func (im *importer) run(versions string, shortname string) error {
+	lines, err := readGzipLines(versions)
+	if err != nil {
+		return err
+	}
+
+	// versions.gz lists the newest first, import the oldest first so ids keep
+	// their order. Every package is imported once with all its tags.
+	var order []string
+	byMD5 := make(map[string][]versionLine)
+	for i := len(lines) - 1; i >= 0; i-- {
+		v, err := parseVersionLine(lines[i])
+		if err != nil {
+			log.Println("Skipping", err)
+			im.failed++
+			continue
+		}
+		if shortname != "" && v.ShortName != shortname {
+			continue
+		}
+		key := v.ShortName + "," + v.MD5
+		if _, ok := byMD5[key]; !ok {
+			order = append(order, key)
+		}
+		byMD5[key] = append(byMD5[key], v)
+	}
+
+	// Held until the versions list the objects, gc would remove them before
+	unlock, err := lockPool(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	im.games = make(map[string]Game)
+	for _, key := range order {
+		tags := byMD5[key]
+		if err := im.importVersion(tags); err != nil {
+			log.Printf("Failed importing %s:%s (%s): %s\n", tags[0].ShortName, tags[0].Tag, tags[0].MD5, err)
+			im.failed++
+		}
+	}
+	return nil
+}
+
+// game returns the game of a shortname, creating it without a git URL if
+// needed.
+func (im *importer) game(shortname string) (Game, error) {
+	if g, ok := im.games[shortname]; ok {
+		return g, nil
+	}
+
+	var g Game
+	err := DB.Where("short_name = ?", shortname).First(&g).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		g = Game{ShortName: shortname, RepoURL: im.repoURL}
+		err = DB.Create(&g).Error
+		if err == nil {
+			log.Printf("Created game %s\n", shortname)
+		}
+	}
+	if err != nil {
+		return Game{}, err
+	}
+
+	im.games[shortname] = g
+	return g, nil
+}
+
+// importVersion imports one package and its tags. Tags like git:<commit> or
+// revision:<n> become aliases, floating ones like stable or test become
+// channels pinned to the version.
+func (im *importer) importVersion(tags []versionLine) error {
+	first := tags[0]
+	game, err := im.game(first.ShortName)
+	if err != nil {
+		return err
+	}
+
+	var aliases, channels []string
+	for _, t := range tags {
+		if strings.Contains(t.Tag, ":") {
+			aliases = append(aliases, t.Tag)
+		} else {
+			channels = append(channels, t.Tag)
+		}
+	}
+
+	// Versions imported before are found by package md5 or by any alias,
+	// the md5 may differ here if the old host ordered packages differently
+	importAlias := "import:" + first.MD5
+	var version GameVersion
+	err = DB.Where("game_id = ? AND version_md5 = ?", game.ID, first.MD5).First(&version).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = DB.Joins("INNER JOIN version_aliases ON version_aliases.game_version_id = game_versions.id").
+			Where("version_aliases.game_id = ? AND version_aliases.version_hash IN ?", game.ID, append(aliases, importAlias)).
+			First(&version).Error
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	var missing []string
+	for _, a := range aliases {
+		var existing VersionAlias
+		if err := DB.Where("game_id = ? AND version_hash = ?", game.ID, a).First(&existing).Error; err == nil {
+			continue
+		}
+		missing = append(missing, a)
+	}
+
+	if version.ID == 0 {
+		aliasHash := importAlias
+		if len(missing) > 0 {
+			aliasHash, missing = missing[0], missing[1:]
+		}
+		v, err := im.createVersion(game, aliasHash, first)
+		if err != nil {
+			return err
+		}
+		version = *v
+		im.versions++
+		im.aliases++
+	}
+
+	for _, a := range missing {
+		alias := VersionAlias{GameID: game.ID, GameVersionID: version.ID, VersionHash: a}
+		if err := DB.Create(&alias).Error; err != nil {
+			return err
+		}
+		im.aliases++
+	}
+
+	for _, name := range channels {
+		taken, err := refTagTaken(DB, game.ID, name)
+		if err != nil {
+			return err
+		}
+		if taken {
+			log.Printf("Not pinning %s:%s, the tag belongs to a ref\n", game.ShortName, name)
+			continue
+		}
+		ch := Channel{GameID: game.ID, Name: name, VersionID: &version.ID}
+		err = DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "game_id"}, {Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"version_id"}),
+		}).Create(&ch).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createVersion reads the .sdp of a package, puts the objects it lists into
+// the pool and registers the version. Imported versions were public
+// upstream, so they are published.
+func (im *importer) createVersion(game Game, aliasHash string, v versionLine) (*GameVersion, error) {
+	records, err := im.readPackage(v.MD5)
+	if err != nil {
+		return nil, err
+	}
+	files, err := im.importObjects(v.MD5, records)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]treeEntry, 0, len(records))
+	for _, rec := range records {
+		file := files[hex.EncodeToString(rec.MD5[:])]
+		entries = append(entries, treeEntry{
+			Path: rec.Filename,
+			Size: int64(rec.Size),
+			File: &file,
+		})
+	}
+
+	jl := log.Default()
+	mi := &ModInfo{Depend: v.Depends}
+	version, err := createVersionLocked(game, aliasHash, v.FullName, mi, entries, nil, im.cfg, jl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hosts order packages differently, the version keeps the md5 clients
+	// already know it by. The objects were checked one by one on the way in.
+	if version.VersionMD5 != v.MD5 {
+		log.Printf("Package %s of %s:%s is %s here\n", v.MD5, game.ShortName, v.Tag, version.VersionMD5)
+		if version.VersionHash == aliasHash {
+			if err := im.rekeyVersion(version, v.MD5); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = DB.Model(version).Update("published", true).Error
+	return version, err
+}
+
+// rekeyVersion renames a version just created to the upstream package md5
+// and moves its .sdp along.
+func (im *importer) rekeyVersion(version *GameVersion, md5sum string) error {
+	old := version.VersionMD5
+	if err := DB.Model(version).Update("version_md5", md5sum).Error; err != nil {
+		return err
+	}
+	if err := writePackage(im.cfg, DB, md5sum); err != nil {
+		return err
+	}
+
+	var n int64
+	if err := DB.Model(&GameVersion{}).Where("version_md5 = ?", old).Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		os.Remove(packagePath(im.cfg, old))
+	}
+	return nil
+}
+
+// readPackage downloads or opens <md5>.sdp and decodes its records.
+func (im *importer) readPackage(md5sum string) ([]SdpRecord, error) {
+	src := im.packages + "/" + md5sum + ".sdp"
+	if !isURL(src) {
+		src = filepath.Join(im.packages, md5sum+".sdp")
+	}
+
+	r, err := openSource(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	defer gz.Close()
+
+	var records []SdpRecord
+	d := NewSdpDecoder(gz)
+	for d.Next() {
+		records = append(records, d.Record())
+	}
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: empty package", src)
+	}
+	return records, nil
+}
+
+// importObjects returns the File of every record by md5, bringing the
+// objects whose md5 isn't known yet into the pool first.
+func (im *importer) importObjects(pkgMD5 string, records []SdpRecord) (map[string]File, error) {
+	md5s := make([]string, 0, len(records))
+	for _, rec := range records {
+		md5s = append(md5s, hex.EncodeToString(rec.MD5[:]))
+	}
+
+	files := make(map[string]File, len(records))
+	for start := 0; start < len(md5s); start += insertBatchSize {
+		var rows []File
+		if err := DB.Where("md5_sum IN ?", md5s[start:min(start+insertBatchSize, len(md5s))]).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, f := range rows {
+			files[f.MD5Sum] = f
+		}
+	}
+
+	// Indexes into records, the order streamer.cgi bitmasks refer to
+	var missing []int
+	seen := make(map[string]bool)
+	for i, md5sum := range md5s {
+		if _, ok := files[md5sum]; ok || seen[md5sum] {
+			continue
+		}
+		seen[md5sum] = true
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return files, nil
+	}
+
+	if im.gameURL != "" {
+		return files, im.download(pkgMD5, records, missing, files)
+	}
+
+	for _, i := range missing {
+		file, err := im.linkObject(records[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", records[i].Filename, err)
+		}
+		files[file.MD5Sum] = file
+	}
+	return files, nil
+}
+
+// linkObject brings the object of a record from the old pool into ours.
+func (im *importer) linkObject(rec SdpRecord) (File, error) {
+	tmp, err := im.poolTemp()
+	if err != nil {
+		return File{}, err
+	}
+	defer os.Remove(tmp)
+
+	src := filepath.Join(im.pool, filepath.FromSlash(poolKey(hex.EncodeToString(rec.MD5[:]))))
+	if err := linkOrCopy(src, tmp, poolTempPrefix+"*", im.copyOnly); err != nil {
+		return File{}, err
+	}
+	return im.storeObject(rec, tmp, src)
+}
+
+// poolTemp returns the name of a new temp file next to the pool, so putting
+// it into a filesystem pool store is a rename.
+func (im *importer) poolTemp() (string, error) {
+	if err := os.MkdirAll(im.cfg.PoolPath, 0750); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(im.cfg.PoolPath, poolTempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	return tmp.Name(), tmp.Close()
+}
+
+// storeObject puts the gzipped object at tmp into the pool and inserts its
+// File. The object has to decompress to the md5, size and CRC32 the .sdp
+// lists, src names where it came from in errors.
+func (im *importer) storeObject(rec SdpRecord, tmp string, src string) (File, error) {
+	md5sum := hex.EncodeToString(rec.MD5[:])
+
+	sums, err := im.objectSums(tmp)
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %w", src, err)
+	}
+	if sums.MD5hex != md5sum || sums.Len != int64(rec.Size) || sums.CRC32 != rec.CRC32 {
+		return File{}, fmt.Errorf("%s: content is %s (%d bytes, crc32 %08x), expected %s (%d bytes, crc32 %08x)",
+			src, sums.MD5hex, sums.Len, sums.CRC32, md5sum, rec.Size, rec.CRC32)
+	}
+
+	if err := pool.Put(md5sum, tmp); err != nil {
+		return File{}, err
+	}
+	im.objects++
+
+	byMD5, err := insertFiles(DB, []File{{
+		MD5Sum:  md5sum,
+		CRC32:   sums.CRC32,
+		SHA256:  sums.SHA256hex,
+		Len:     uint64(sums.Len),
+		PoolLen: sums.PoolLen,
+	}})
+	if err != nil {
+		return File{}, err
+	}
+	return byMD5[md5sum], nil
+}
+
+// objectSums hashes the content of a gzipped object and records its size.
+func (im *importer) objectSums(path string) (*FileChecksums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	sums, err := ReaderSums(gzr, im.cfg.HashSHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sums.PoolLen = fi.Size()
+	return sums, nil
+}
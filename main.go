@@ -1,6 +1,9 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 )
@@ -19,8 +22,22 @@ func main() {
 		panic(err)
 	}
 	InitDB(cfg)
+	InitPool(cfg)
+
+	if len(os.Args) > 2 {
+		if err := RunCommand(cfg, os.Args[2], os.Args[3:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	CleanPool(cfg)
+	StartBuilder(cfg)
 	StartGitPoller(cfg)
+	StartMirrorChecker(cfg)
+	StartPoolVerifier(cfg)
+	StartReplicator(cfg)
 
-	r := SetupRouter()
+	r := SetupRouter(cfg)
 	r.Run(":8080")
 }
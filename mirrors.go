@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Pool objects fetched from each mirror per check
+const mirrorSpotChecks = 5
+
+var mirrorClient = &http.Client{Timeout: 60 * time.Second}
+
+// mirrorChecks holds the ids of mirrors to check ahead of the next round
+var mirrorChecks = make(chan uint, 64)
+
+func StartMirrorChecker(cfg Config) {
+	interval := time.Duration(cfg.MirrorCheckInterval) * time.Minute
+	if interval <= 0 {
+		interval = 30 * time.Minute
+	}
+
+	go func() {
+		round := time.NewTimer(0)
+		for {
+			select {
+			case id := <-mirrorChecks:
+				var m Mirror
+				if err := DB.First(&m, id).Error; err == nil {
+					CheckMirror(m)
+				}
+			case <-round.C:
+				var mirrors []Mirror
+				DB.Where("enabled = true").Find(&mirrors)
+
+				for _, m := range mirrors {
+					CheckMirror(m)
+				}
+				round.Reset(interval)
+			}
+		}
+	}()
+}
+
+// EnqueueMirrorCheck asks the mirror checker to check a mirror as soon as
+// possible. It returns false when too many checks are already queued.
+func EnqueueMirrorCheck(id uint) bool {
+	select {
+	case mirrorChecks <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckMirror downloads a few random pool objects from the mirror and marks
+// it unhealthy, which drops it from repos.gz, unless all of them match the
+// File table.
+func CheckMirror(m Mirror) {
+	err := spotCheckMirror(m)
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"last_check": now,
+		"healthy":    err == nil,
+		"last_error": "",
+	}
+	if err != nil {
+		log.Printf("Mirror %s failed spot check: %s\n", m.BaseURL, err)
+		updates["last_error"] = err.Error()
+	} else {
+		updates["last_sync"] = now
+	}
+
+	DB.Model(&Mirror{}).Where("id = ?", m.ID).Updates(updates)
+}
+
+func spotCheckMirror(m Mirror) error {
+	files, err := randomMirrorFiles(m)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := checkMirrorFile(m, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// randomMirrorFiles picks up to mirrorSpotChecks files the mirror should
+// have. Each pick seeks to the first file at or after a random id, sorting
+// the whole table by random() is too slow once the pool is large.
+func randomMirrorFiles(m Mirror) ([]File, error) {
+	var maxID uint
+	if err := DB.Model(&File{}).Select("COALESCE(MAX(id), 0)").Scan(&maxID).Error; err != nil {
+		return nil, err
+	}
+	if maxID == 0 {
+		return nil, nil
+	}
+
+	used := `EXISTS (SELECT 1 FROM version_files
+		INNER JOIN game_versions ON game_versions.id = version_files.game_version_id
+		WHERE version_files.file_id = files.id`
+	args := []interface{}{}
+	if m.GameID != nil {
+		used += " AND game_versions.game_id = ?"
+		args = append(args, *m.GameID)
+	}
+	used += ")"
+
+	var files []File
+	picked := make(map[uint]bool)
+	for i := 0; i < mirrorSpotChecks; i++ {
+		start := uint(rand.Int64N(int64(maxID))) + 1
+
+		var f File
+		err := DB.Where(used, args...).Where("files.id >= ?", start).Order("files.id").Limit(1).Find(&f).Error
+		if err == nil && f.ID == 0 {
+			//Wrap around to the lowest id
+			err = DB.Where(used, args...).Order("files.id").Limit(1).Find(&f).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+		if f.ID == 0 {
+			break
+		}
+		if !picked[f.ID] {
+			picked[f.ID] = true
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func checkMirrorFile(m Mirror, f File) error {
+	resp, err := mirrorClient.Get(m.PoolURL(f.MD5Sum))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", m.PoolURL(f.MD5Sum), resp.Status)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.PoolURL(f.MD5Sum), err)
+	}
+	defer gz.Close()
+
+	h := md5.New()
+	n, err := io.Copy(h, gz)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.PoolURL(f.MD5Sum), err)
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != f.MD5Sum || uint64(n) != f.Len {
+		return fmt.Errorf("%s: got md5 %s and %d bytes", m.PoolURL(f.MD5Sum), sum, n)
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
+	"regexp"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type Game struct {
@@ -11,42 +15,300 @@ type Game struct {
 	ShortName string `gorm:"uniqueIndex"`
 	RepoURL   string
 	GitURL    string
-	CreatedAt time.Time
+	// WebhookSecret signs push/tag webhooks, empty disables the endpoint
+	WebhookSecret string
+	// UploadToken authenticates the upload API, empty disables it
+	UploadToken string
+	// KeepBuilds is how many untagged, unpublished builds gc keeps, 0 keeps all
+	KeepBuilds int
+	CreatedAt  time.Time
 
 	Versions []GameVersion
+	Refs     []GameRef
+}
+
+// Kinds of GameRef
+const (
+	RefBranch = "branch"
+	RefTag    = "tag"
+)
+
+// GameRef is a branch or tag pattern the poller builds, published in
+// versions.gz as <shortname>:<Tag>.
+type GameRef struct {
+	ID     uint `gorm:"primaryKey"`
+	GameID uint `gorm:"index"`
+	Kind   string
+	// Name is a remote branch name (HEAD for the default branch) or a tag glob
+	Name string
+	Tag  string
+	// Head is the newest commit of the ref at the last scan, VersionID the
+	// newest version built from the ref.
+	Head      string
+	VersionID *uint
+	Version   *GameVersion
+}
+
+func (r GameRef) RapidTag() string {
+	if r.Tag == "" {
+		return "test"
+	}
+	return r.Tag
+}
+
+// refTagTaken reports whether a ref of the game publishes tag. Refs and
+// channels share the <shortname>:<tag> namespace of versions.gz.
+func refTagTaken(db *gorm.DB, gameID uint, tag string) (bool, error) {
+	q := db.Model(&GameRef{}).Where("game_id = ?", gameID)
+	if tag == "test" {
+		q = q.Where("tag = ? OR tag = ''", tag)
+	} else {
+		q = q.Where("tag = ?", tag)
+	}
+	var n int64
+	err := q.Count(&n).Error
+	return n > 0, err
+}
+
+// channelTaken reports whether the game has a channel called name.
+func channelTaken(db *gorm.DB, gameID uint, name string) (bool, error) {
+	var n int64
+	err := db.Model(&Channel{}).Where("game_id = ? AND name = ?", gameID, name).Count(&n).Error
+	return n > 0, err
+}
+
+// DefaultRef tracks the default branch as <shortname>:test, like the poller
+// always did before refs were configurable.
+func DefaultRef(gameID uint) GameRef {
+	return GameRef{
+		GameID: gameID,
+		Kind:   RefBranch,
+		Name:   "HEAD",
+		Tag:    "test",
+	}
 }
 
 type GameVersion struct {
 	ID          uint   `gorm:"primaryKey"`
-	GameID      uint   `gorm:"index"`
-	VersionHash string `gorm:"uniqueIndex"`
-	VersionMD5  string
+	GameID      uint   `gorm:"index;uniqueIndex:idx_game_version_hash"`
+	VersionHash string `gorm:"uniqueIndex:idx_game_version_hash"`
+	VersionMD5  string `gorm:"index"`
 	FullName    string
-	Progressive int64
-	Published   bool `gorm:"default:true;index"`
-	CreatedAt   time.Time
+	// Taken from modinfo at build time
+	ModName      string
+	ModShortName string
+	ModVersion   string
+	Mutator      string
+	Description  string
+	Progressive  int64
+	// Builds start unpublished, gc keeps only the newest KeepBuilds of them
+	Published bool `gorm:"default:false;index"`
+	CreatedAt time.Time
+
+	Depends []VersionDepend
+	Aliases []VersionAlias
+}
+
+// VersionAlias maps a build identifier such as git:<tag or commit> to the
+// content addressed version it produced, identical trees share one version.
+// Aliases are unique per game, tags like v1.0 repeat across games.
+type VersionAlias struct {
+	ID            uint `gorm:"primaryKey"`
+	GameID        uint `gorm:"index;uniqueIndex:idx_version_alias_hash"`
+	GameVersionID uint `gorm:"index"`
+	GameVersion   GameVersion
+	VersionHash   string `gorm:"uniqueIndex:idx_version_alias_hash"`
+	CreatedAt     time.Time
+}
+
+// VersionDepend is one entry of the modinfo depend list, an archive name
+// pr-downloader has to fetch before the version can be used.
+type VersionDepend struct {
+	ID            uint `gorm:"primaryKey"`
+	GameVersionID uint `gorm:"index"`
+	Position      int
+	Name          string
+}
+
+// DependsColumn formats the depends column of a versions.gz line.
+func (v GameVersion) DependsColumn() string {
+	names := make([]string, 0, len(v.Depends))
+	for _, d := range v.Depends {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, "|")
+}
+
+// orderDepends keeps preloaded depends in modinfo order.
+func orderDepends(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+// Channel is a named alias in versions.gz, e.g. <shortname>:stable. It is
+// either pinned to a version or follows the newest version matching its rule.
+type Channel struct {
+	ID     uint   `gorm:"primaryKey"`
+	GameID uint   `gorm:"uniqueIndex:idx_channel_game_name"`
+	Name   string `gorm:"uniqueIndex:idx_channel_game_name"`
+	// VersionID pins the channel, nil follows the rule
+	VersionID *uint
+	Version   *GameVersion
+	// Rule: newest version, only published ones if set, with a full name
+	// matching Match if not empty
+	PublishedOnly bool
+	Match         string
+	CreatedAt     time.Time
+}
+
+// Resolve returns the version the channel currently points at, nil if none.
+// Database errors are returned, they must not look like an empty channel.
+func (ch Channel) Resolve(db *gorm.DB) (*GameVersion, error) {
+	db = db.Preload("Depends", orderDepends)
+
+	if ch.VersionID != nil {
+		var v GameVersion
+		if err := db.First(&v, *ch.VersionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	var match *regexp.Regexp
+	if ch.Match != "" {
+		var err error
+		if match, err = regexp.Compile(ch.Match); err != nil {
+			return nil, err
+		}
+	}
+
+	q := db.Where("game_id = ?", ch.GameID).Order("id DESC")
+	if ch.PublishedOnly {
+		q = q.Where("published = true")
+	}
+	if match == nil {
+		var v GameVersion
+		if err := q.First(&v).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	var versions []GameVersion
+	if err := q.Limit(1000).Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		if match.MatchString(versions[i].FullName) {
+			return &versions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// DefaultChannel follows the newest published version as <shortname>:stable.
+func DefaultChannel(gameID uint) Channel {
+	return Channel{
+		GameID:        gameID,
+		Name:          "stable",
+		PublishedOnly: true,
+	}
+}
+
+// Mirror is a static copy of the repository, e.g. made with the export
+// command, advertised next to this server in repos.gz while it passes the
+// pool spot checks.
+type Mirror struct {
+	ID uint `gorm:"primaryKey"`
+	// GameID restricts the mirror to one game, nil mirrors all of them
+	GameID   *uint `gorm:"index"`
+	Game     *Game
+	BaseURL  string
+	Region   string
+	Priority int
+	Enabled  bool
+	Healthy  bool
+	// LastSync is the last time the mirror passed a spot check
+	LastSync  *time.Time
+	LastCheck *time.Time
+	LastError string
+	CreatedAt time.Time
+}
+
+// GameURL is the repository URL of a game on the mirror.
+func (m Mirror) GameURL(g Game) string {
+	return strings.TrimSuffix(m.BaseURL, "/") + "/" + g.ShortName
+}
+
+// PoolURL is the URL of a pool object on the mirror.
+func (m Mirror) PoolURL(md5sum string) string {
+	return strings.TrimSuffix(m.BaseURL, "/") + "/pool/" + md5sum[0:2] + "/" + md5sum[2:] + ".gz"
 }
 
 type File struct {
 	ID     uint   `gorm:"primaryKey"`
-	MD5Sum string `gorm:"index"`
+	MD5Sum string `gorm:"uniqueIndex:idx_files_md5"`
 	CRC32  uint32 `gorm:"index"`
+	// SHA256 is only filled when Config.HashSHA256 is set
+	SHA256 string
 	Len    uint64
+	// PoolLen is the size of the gzipped pool object, 0 until it is known
+	PoolLen int64
+}
+
+// BlobFile remembers which File a git blob hashed to, so builds only read
+// the blobs that changed since the last build.
+type BlobFile struct {
+	BlobSHA string `gorm:"primaryKey"`
+	FileID  uint   `gorm:"index"`
 }
 
 type VersionFile struct {
 	ID            uint   `gorm:"primaryKey"`
-	GameVersionID uint   `gorm:"index"`
+	GameVersionID uint   `gorm:"index;uniqueIndex:idx_version_file_path"`
 	FileID        uint   `gorm:"index"`
-	Path          string `gorm:"index"`
+	Path          string `gorm:"index;uniqueIndex:idx_version_file_path"`
 }
 
 type FileP struct {
-	ID     uint
-	MD5Sum string
-	CRC32  uint32
-	Len    uint64
-	Path   string
+	ID      uint
+	MD5Sum  string
+	CRC32   uint32
+	Len     uint64
+	PoolLen int64
+	Path    string
+}
+
+// Build job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	// JobCollected is a succeeded build whose version gc removed, the commit
+	// isn't built again
+	JobCollected = "collected"
+)
+
+type BuildJob struct {
+	ID            uint `gorm:"primaryKey"`
+	GameID        uint `gorm:"index"`
+	Game          Game
+	GameRefID     uint
+	CommitHash    string `gorm:"index"`
+	Tag           string
+	State         string `gorm:"index"`
+	GameVersionID *uint
+	Log           string
+	Error         string
+	StartedAt     *time.Time
+	FinishedAt    *time.Time
+	CreatedAt     time.Time
 }
 
 type Admin struct {
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ModInfo holds the fields of modinfo.lua (or modinfo.tdf) we publish.
+type ModInfo struct {
+	Name        string
+	ShortName   string
+	Version     string
+	Mutator     string
+	Description string
+	Depend      []string
+}
+
+// FullName is the name spring and pr-downloader show for the archive.
+func (mi *ModInfo) FullName() string {
+	if mi.Name == "" || mi.Version == "" {
+		return ""
+	}
+	return mi.Name + " " + mi.Version
+}
+
+// modinfo.lua only builds a table, anything slower than this is broken
+const modinfoTimeout = 2 * time.Second
+
+// Longest string string.rep may build, the VM has no memory limit
+const modinfoMaxRep = 1 << 20
+
+// loadModInfo reads modinfo.lua, falling back to modinfo.tdf, through read
+// and substitutes $VERSION. It returns the parsed info, the name of the file
+// and its substituted content so the caller can ship it. A game without any
+// modinfo returns nil and no error.
+func loadModInfo(read func(name string) ([]byte, error), version string) (*ModInfo, string, string, error) {
+	for _, name := range []string{"modinfo.lua", "modinfo.tdf"} {
+		content, err := read(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		src := strings.ReplaceAll(string(content), "$VERSION", version)
+
+		var mi *ModInfo
+		if name == "modinfo.lua" {
+			mi, err = ParseModInfoLua(src, version)
+		} else {
+			mi, err = ParseModInfoTDF(src)
+		}
+		if err != nil {
+			return nil, "", "", fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return mi, name, src, nil
+	}
+
+	return nil, "", "", nil
+}
+
+// substituteModInfo parses the modinfo of a version being built and makes the
+// version ship it with $VERSION substituted instead of the original content.
+func substituteModInfo(entries []treeEntry, br blobReader, version string, jl *log.Logger) (*ModInfo, error) {
+	mi, name, content, err := loadModInfo(func(name string) ([]byte, error) {
+		for _, e := range entries {
+			if e.Path == name {
+				return e.readAll(br)
+			}
+		}
+		return nil, os.ErrNotExist
+	}, version)
+	if err != nil || mi == nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].Path == name {
+			entries[i].Content = []byte(content)
+			entries[i].Size = int64(len(content))
+			entries[i].BlobSHA = ""
+			entries[i].Source = ""
+		}
+	}
+
+	jl.Printf("Overridden version in %s\n", name)
+	return mi, nil
+}
+
+// ParseModInfoLua evaluates modinfo.lua in a sandboxed VM without io, os or
+// module loading. VERSION is available as a global for modinfos that don't
+// rely on the $VERSION placeholder.
+func ParseModInfoLua(src string, version string) (*ModInfo, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   256,
+		RegistryMaxSize: 1 << 16,
+	})
+	defer L.Close()
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("VERSION", lua.LString(version))
+
+	// One string.rep call could allocate gigabytes before the timeout hits
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+			s := L.CheckString(1)
+			n := L.CheckInt(2)
+			if n <= 0 {
+				L.Push(lua.LString(""))
+				return 1
+			}
+			if int64(len(s))*int64(n) > modinfoMaxRep {
+				L.RaiseError("string.rep result longer than %d bytes", modinfoMaxRep)
+			}
+			L.Push(lua.LString(strings.Repeat(s, n)))
+			return 1
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), modinfoTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	if err := L.DoString(src); err != nil {
+		return nil, err
+	}
+
+	tbl, ok := L.Get(-1).(*lua.LTable)
+	if !ok {
+		return nil, errors.New("modinfo.lua must return a table")
+	}
+
+	field := func(key string) string {
+		switch v := tbl.RawGetString(key).(type) {
+		case lua.LString:
+			return string(v)
+		case lua.LNumber:
+			return v.String()
+		case lua.LBool:
+			return strconv.FormatBool(bool(v))
+		}
+		return ""
+	}
+
+	mi := &ModInfo{
+		Name:        field("name"),
+		ShortName:   field("shortname"),
+		Version:     field("version"),
+		Mutator:     field("mutator"),
+		Description: field("description"),
+	}
+
+	if depend, ok := tbl.RawGetString("depend").(*lua.LTable); ok {
+		n := depend.Len()
+		for i := 1; i <= n; i++ {
+			if s, ok := depend.RawGetInt(i).(lua.LString); ok && s != "" {
+				mi.Depend = append(mi.Depend, string(s))
+			}
+		}
+	}
+
+	return mi, nil
+}
+
+var (
+	tdfComments = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*`)
+	tdfDepend   = regexp.MustCompile(`^depend(\d+)$`)
+)
+
+// ParseModInfoTDF reads the legacy [MODINFO] section, with dependencies given
+// as Depend0..DependN either inline or in a [DEPEND] subsection.
+func ParseModInfoTDF(src string) (*ModInfo, error) {
+	src = tdfComments.ReplaceAllString(src, "")
+
+	values := make(map[string]string)
+	var sections []string
+	var pending string
+
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		for line != "" {
+			switch {
+			case line[0] == '[':
+				end := strings.IndexByte(line, ']')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated section: %s", line)
+				}
+				pending = strings.ToLower(strings.TrimSpace(line[1:end]))
+				line = line[end+1:]
+			case line[0] == '{':
+				if pending == "" {
+					return nil, errors.New("block without section name")
+				}
+				sections = append(sections, pending)
+				pending = ""
+				line = line[1:]
+			case line[0] == '}':
+				if len(sections) == 0 {
+					return nil, errors.New("unbalanced '}'")
+				}
+				sections = sections[:len(sections)-1]
+				line = line[1:]
+			default:
+				end := strings.IndexByte(line, ';')
+				if end < 0 {
+					return nil, fmt.Errorf("missing ';': %s", line)
+				}
+				key, value, ok := strings.Cut(line[:end], "=")
+				if !ok {
+					return nil, fmt.Errorf("invalid line: %s", line)
+				}
+				path := append(append([]string{}, sections...), strings.ToLower(strings.TrimSpace(key)))
+				values[strings.Join(path, "\\")] = strings.TrimSpace(value)
+				line = line[end+1:]
+			}
+			line = strings.TrimSpace(line)
+		}
+	}
+	if len(sections) != 0 {
+		return nil, errors.New("unbalanced '{'")
+	}
+
+	mi := &ModInfo{
+		Name:        values["modinfo\\name"],
+		ShortName:   values["modinfo\\shortname"],
+		Version:     values["modinfo\\version"],
+		Mutator:     values["modinfo\\mutator"],
+		Description: values["modinfo\\description"],
+	}
+	if mi.Name == "" {
+		return nil, errors.New("no [MODINFO] name")
+	}
+
+	depends := make(map[int]string)
+	for key, value := range values {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "modinfo\\"), "depend\\")
+		if m := tdfDepend.FindStringSubmatch(key); m != nil && value != "" {
+			n, _ := strconv.Atoi(m[1])
+			depends[n] = value
+		}
+	}
+	idx := make([]int, 0, len(depends))
+	for n := range depends {
+		idx = append(idx, n)
+	}
+	sort.Ints(idx)
+	for _, n := range idx {
+		mi.Depend = append(mi.Depend, depends[n])
+	}
+
+	return mi, nil
+}
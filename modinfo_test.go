@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseModInfoLua(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want ModInfo
+	}{
+		{
+			"double quotes",
+			`return { name = "Balanced Annihilation", shortname = "BA", version = "v1.0" }`,
+			ModInfo{Name: "Balanced Annihilation", ShortName: "BA", Version: "v1.0"},
+		},
+		{
+			"single quotes and long strings",
+			`return { name = 'Game', description = [[multi
+line]] }`,
+			ModInfo{Name: "Game", Description: "multi\nline"},
+		},
+		{
+			"nested depend and modoptions",
+			`local modinfo = {
+				name = "Game",
+				depend = { "Spring Bitmaps", "Spring Cursors", { "not a name" } },
+				modoptions = { { key = "startmetal", type = "number", def = 1000 } },
+			}
+			return modinfo`,
+			ModInfo{Name: "Game", Depend: []string{"Spring Bitmaps", "Spring Cursors"}},
+		},
+		{
+			"comments",
+			`-- name = "Wrong",
+			--[[ return { name = "Wrong" } ]]
+			return { name = "Game", -- trailing
+				version = "1" --[==[ block ]==] }`,
+			ModInfo{Name: "Game", Version: "1"},
+		},
+		{
+			"concatenation",
+			`local base = "Game"
+			return { name = base .. " " .. "Extended", version = "test-" .. 42 }`,
+			ModInfo{Name: "Game Extended", Version: "test-42"},
+		},
+		{
+			"VERSION global",
+			`return { name = "Game", version = VERSION }`,
+			ModInfo{Name: "Game", Version: "test-7-abcdef0"},
+		},
+		{
+			"numbers and booleans",
+			`return { name = "Game", version = 2, mutator = true }`,
+			ModInfo{Name: "Game", Version: "2", Mutator: "true"},
+		},
+		{
+			"short string.rep",
+			`return { name = "Game", description = string.rep("-", 3) .. ("ab"):rep(2) }`,
+			ModInfo{Name: "Game", Description: "---abab"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi, err := ParseModInfoLua(tt.src, "test-7-abcdef0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mi.Name != tt.want.Name || mi.ShortName != tt.want.ShortName || mi.Version != tt.want.Version ||
+				mi.Mutator != tt.want.Mutator || mi.Description != tt.want.Description ||
+				strings.Join(mi.Depend, "|") != strings.Join(tt.want.Depend, "|") {
+				t.Errorf("got %+v, want %+v", *mi, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseModInfoLuaErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"syntax error", `return { name = "Game"`},
+		{"no table", `return "Game"`},
+		{"os", `return { name = os.getenv("HOME") }`},
+		{"io", `return { name = io.open("/etc/passwd"):read("*a") }`},
+		{"require", `require("socket") return {}`},
+		{"loadstring", `return loadstring("return {}")()`},
+		{"dofile", `return dofile("/etc/passwd")`},
+		{"huge string.rep", `return { name = string.rep("x", 1024 * 1024 * 1024) }`},
+		{"huge rep method", `return { name = ("xx"):rep(1024 * 1024) }`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mi, err := ParseModInfoLua(tt.src, "1"); err == nil {
+				t.Errorf("parsed as %+v", *mi)
+			}
+		})
+	}
+}
+
+func TestParseModInfoLuaTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := ParseModInfoLua(`while true do end`, "1")
+	if err == nil {
+		t.Fatal("endless loop parsed")
+	}
+	if d := time.Since(start); d > modinfoTimeout+time.Second {
+		t.Errorf("took %s to time out", d)
+	}
+}
+
+func TestParseModInfoTDF(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want ModInfo
+	}{
+		{
+			"DEPEND section",
+			`[MODINFO]
+			{
+				Name=Old Game;
+				ShortName=OG;
+				Version=3.1;
+				Description=An old game; // not part of it
+				/* Name=Wrong; */
+				[DEPEND]
+				{
+					Depend1=Spring Cursors;
+					Depend0=Spring Bitmaps;
+				}
+			}`,
+			ModInfo{Name: "Old Game", ShortName: "OG", Version: "3.1", Description: "An old game",
+				Depend: []string{"Spring Bitmaps", "Spring Cursors"}},
+		},
+		{
+			"inline depends",
+			`[MODINFO] { name=Game; depend0=Spring Bitmaps; depend2=; }`,
+			ModInfo{Name: "Game", Depend: []string{"Spring Bitmaps"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi, err := ParseModInfoTDF(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mi.Name != tt.want.Name || mi.ShortName != tt.want.ShortName || mi.Version != tt.want.Version ||
+				mi.Description != tt.want.Description || strings.Join(mi.Depend, "|") != strings.Join(tt.want.Depend, "|") {
+				t.Errorf("got %+v, want %+v", *mi, tt.want)
+			}
+		})
+	}
+
+	for _, src := range []string{
+		`[MODINFO] { name=Game; `,
+		`[MODINFO] { name=Game }`,
+		`{ name=Game; }`,
+		`[OTHER] { name=Game; }`,
+	} {
+		if _, err := ParseModInfoTDF(src); err == nil {
+			t.Errorf("parsed %q", src)
+		}
+	}
+}
+
+func TestLoadModInfoSubstitutesVersion(t *testing.T) {
+	files := map[string]string{
+		"modinfo.lua": `return { name = "Game", version = "$VERSION" }`,
+		"modinfo.tdf": `[MODINFO] { name=Wrong; }`,
+	}
+	read := func(name string) ([]byte, error) {
+		if s, ok := files[name]; ok {
+			return []byte(s), nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	mi, name, content, err := loadModInfo(read, "test-12-0123abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "modinfo.lua" || mi.Version != "test-12-0123abc" || mi.FullName() != "Game test-12-0123abc" {
+		t.Errorf("loaded %s as %+v", name, *mi)
+	}
+	if strings.Contains(content, "$VERSION") || !strings.Contains(content, "test-12-0123abc") {
+		t.Errorf("shipped content %q", content)
+	}
+
+	// modinfo.tdf is the fallback
+	delete(files, "modinfo.lua")
+	files["modinfo.tdf"] = `[MODINFO] { name=Game; version=$VERSION; }`
+	if mi, name, _, err := loadModInfo(read, "2"); err != nil || name != "modinfo.tdf" || mi.Version != "2" {
+		t.Errorf("tdf fallback: %v, %s, %v", mi, name, err)
+	}
+
+	// No modinfo at all is not an error
+	delete(files, "modinfo.tdf")
+	if mi, _, _, err := loadModInfo(read, "3"); mi != nil || err != nil {
+		t.Errorf("without modinfo: %v, %v", mi, err)
+	}
+}
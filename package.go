@@ -0,0 +1,59 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+)
+
+// packagePath is where the gzipped .sdp of a version is cached. Packages are
+// named by their content MD5, so a cached file never goes stale and only has
+// to be written again when it is missing.
+func packagePath(cfg Config, md5sum string) string {
+	return filepath.Join(cfg.PoolPath, "packages", md5sum+".sdp")
+}
+
+// writePackage renders the .sdp of a version from the database and atomically
+// replaces the cached file.
+func writePackage(cfg Config, tx *gorm.DB, md5sum string) error {
+	records, err := GetSDPRecords(tx, md5sum)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(packagePath(cfg, md5sum))
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, md5sum+".sdp.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	if err := NewSdpEncoder(gz).EncodeAll(records); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), packagePath(cfg, md5sum)); err != nil {
+		return fmt.Errorf("failed to write package %s: %w", md5sum, err)
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type FileChecksums struct {
+	MD5hex    string
+	MD5       [16]byte
+	CRC32     uint32
+	SHA256hex string
+	Len       int64
+	// PoolLen is the size of the gzipped pool object, only set when an object
+	// is put into the pool
+	PoolLen int64
+}
+
+// multiHash computes every checksum we store from a single stream.
+type multiHash struct {
+	md5    hash.Hash
+	crc32  hash.Hash32
+	sha256 hash.Hash
+	n      int64
+}
+
+func newMultiHash(withSHA256 bool) *multiHash {
+	m := &multiHash{
+		md5:   md5.New(),
+		crc32: crc32.New(crc32.IEEETable),
+	}
+	if withSHA256 {
+		m.sha256 = sha256.New()
+	}
+	return m
+}
+
+func (m *multiHash) Write(p []byte) (int, error) {
+	m.md5.Write(p)
+	m.crc32.Write(p)
+	if m.sha256 != nil {
+		m.sha256.Write(p)
+	}
+	m.n += int64(len(p))
+	return len(p), nil
+}
+
+func (m *multiHash) Sums() *FileChecksums {
+	ret := FileChecksums{
+		MD5:   [16]byte(m.md5.Sum(nil)),
+		CRC32: m.crc32.Sum32(),
+		Len:   m.n,
+	}
+	ret.MD5hex = hex.EncodeToString(ret.MD5[:])
+	if m.sha256 != nil {
+		ret.SHA256hex = hex.EncodeToString(m.sha256.Sum(nil))
+	}
+	return &ret
+}
+
+func FileSums(path string) (*FileChecksums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReaderSums(f, false)
+}
+
+func ReaderSums(r io.Reader, withSHA256 bool) (*FileChecksums, error) {
+	h := newMultiHash(withSHA256)
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sums(), nil
+}
+
+// HashToPool hashes r and gzips it into the pool in the same pass. The pool
+// key depends on the MD5, so the object is written to a temp file first,
+// read back to verify it, synced and put into the pool store. An existing object is
+// kept unless it differs from the recorded size, or fails the same check when
+// no size is recorded, so a truncated object left by a crash gets repaired by
+// the next build shipping the file. If want is set the content must hash to that md5, anything else
+// is dropped before it reaches the pool.
+func HashToPool(cfg Config, r io.Reader, want string) (*FileChecksums, error) {
+	return hashToPool(cfg, r, want, false)
+}
+
+// ReplacePoolObject is HashToPool for objects known to be broken, it always
+// overwrites the existing object.
+func ReplacePoolObject(cfg Config, r io.Reader, want string) (*FileChecksums, error) {
+	return hashToPool(cfg, r, want, true)
+}
+
+func hashToPool(cfg Config, r io.Reader, want string, replace bool) (*FileChecksums, error) {
+	if err := os.MkdirAll(cfg.PoolPath, 0750); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(cfg.PoolPath, poolTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := newMultiHash(cfg.HashSHA256)
+	gzw := gzip.NewWriter(tmp)
+
+	if _, err := io.Copy(io.MultiWriter(h, gzw), r); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	sums := h.Sums()
+	if want != "" && sums.MD5hex != want {
+		return nil, fmt.Errorf("content hashes to %s, expected %s", sums.MD5hex, want)
+	}
+	if err := verifyPoolFile(tmp.Name(), sums); err != nil {
+		return nil, err
+	}
+
+	if !replace {
+		existing, err := existingPoolObject(sums)
+		if err == nil {
+			sums.PoolLen = existing
+			return sums, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Replacing pool object %s: %s\n", sums.MD5hex, err)
+		}
+	}
+
+	fi, err := os.Stat(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	sums.PoolLen = fi.Size()
+
+	if err := pool.Put(sums.MD5hex, tmp.Name()); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// existingPoolObject returns the size of a pool object that can be kept. An
+// object with a recorded size is only compared by size, reading it back would
+// mean a full download from S3 for every build. Objects from before sizes
+// were recorded, or marked broken by verify-pool, are read back once and
+// checked against want; the size is recorded by the caller afterwards.
+func existingPoolObject(want *FileChecksums) (int64, error) {
+	md5sum := want.MD5hex
+	size, err := pool.Stat(md5sum)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, errors.New("empty object")
+	}
+
+	var file File
+	err = DB.Where("md5_sum = ?", md5sum).Limit(1).Find(&file).Error
+	if err != nil {
+		return 0, err
+	}
+	if file.PoolLen != 0 {
+		if file.PoolLen != size {
+			return 0, fmt.Errorf("object is %d bytes, expected %d", size, file.PoolLen)
+		}
+		return size, nil
+	}
+
+	got, err := PoolObjectSums(md5sum)
+	if err != nil {
+		return 0, err
+	}
+	if err := sameContent(got, want); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Prefix of pool objects being written, see CleanPool
+const poolTempPrefix = ".incoming-"
+
+// PoolObjectSums gunzips a pool object and hashes its content.
+func PoolObjectSums(md5sum string) (*FileChecksums, error) {
+	r, err := pool.Open(md5sum)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return gzipSums(r)
+}
+
+func gzipSums(r io.Reader) (*FileChecksums, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	return ReaderSums(gzr, false)
+}
+
+// verifyPoolFile checks that the gzipped file at path decompresses to the
+// content described by sums.
+func verifyPoolFile(path string, sums *FileChecksums) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	got, err := gzipSums(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return sameContent(got, sums)
+}
+
+func sameContent(got, want *FileChecksums) error {
+	if got.MD5 != want.MD5 || got.Len != want.Len {
+		return fmt.Errorf("content is %s (%d bytes), expected %s (%d bytes)", got.MD5hex, got.Len, want.MD5hex, want.Len)
+	}
+	return nil
+}
+
+// syncDir makes a rename into dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// CleanPool removes the temp files of pool objects, packages and uploads left
+// behind by a crash. It must run before builds start.
+func CleanPool(cfg Config) {
+	patterns := []string{
+		filepath.Join(cfg.PoolPath, poolTempPrefix+"*"),
+		filepath.Join(cfg.PoolPath, "packages", "*.sdp.tmp*"),
+		filepath.Join(cfg.PoolPath, uploadTempPrefix+"*"),
+	}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			log.Println("Removing stray temp file", m)
+			if err := os.RemoveAll(m); err != nil {
+				log.Println("Failed removing temp file:", err)
+			}
+		}
+	}
+}
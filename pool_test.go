@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHashToPoolRepairsTruncatedObjects puts a truncated object in place of
+// a file from before pool sizes were recorded, the next HashToPool of the
+// file has to replace it.
+func TestHashToPoolRepairsTruncatedObjects(t *testing.T) {
+	cfg := testDB(t)
+
+	data := bytes.Repeat([]byte("unit "), 1000)
+	sum := md5.Sum(data)
+	md5sum := hex.EncodeToString(sum[:])
+
+	gz := gzBytes(t, data)
+	tmp := filepath.Join(cfg.PoolPath, poolTempPrefix+"truncated")
+	if err := os.WriteFile(tmp, gz[:len(gz)/2], 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Put(md5sum, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&File{MD5Sum: md5sum, Len: uint64(len(data))}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sums, err := HashToPool(cfg, bytes.NewReader(data), md5sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := PoolObjectSums(md5sum); err != nil || got.MD5hex != md5sum {
+		t.Errorf("object not repaired: %v, %v", got, err)
+	}
+	if size, _ := pool.Stat(md5sum); size != sums.PoolLen {
+		t.Errorf("pool size %d, object is %d bytes", sums.PoolLen, size)
+	}
+
+	// With the size recorded the object is kept without reading it
+	DB.Model(&File{}).Where("md5_sum = ?", md5sum).Update("pool_len", sums.PoolLen)
+	if _, err := HashToPool(cfg, bytes.NewReader(data), md5sum); err != nil {
+		t.Fatal(err)
+	}
+}
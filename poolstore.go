@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var pool PoolStore
+
+// PoolStore holds the gzipped pool objects, addressed by the MD5 of their
+// uncompressed content. Missing objects are reported as os.ErrNotExist.
+type PoolStore interface {
+	// Put moves the gzipped object at path, a temp file under PoolPath, into
+	// the store, replacing any existing object.
+	Put(md5sum string, path string) error
+	Open(md5sum string) (io.ReadCloser, error)
+	// Stat returns the compressed size of an object.
+	Stat(md5sum string) (int64, error)
+	Delete(md5sum string) error
+	// List calls fn with the MD5 of every object in the store.
+	List(fn func(md5sum string) error) error
+}
+
+// InitPool opens the pool store selected in the config.
+func InitPool(cfg Config) {
+	var err error
+	pool, err = NewPoolStore(cfg)
+	if err != nil {
+		log.Fatal("failed to open pool store:", err)
+	}
+}
+
+func NewPoolStore(cfg Config) (PoolStore, error) {
+	switch cfg.PoolStore {
+	case "", "fs":
+		return &fsStore{root: cfg.PoolPath}, nil
+	case "s3":
+		return newS3Store(cfg.S3)
+	}
+	return nil, fmt.Errorf("unknown pool store %q", cfg.PoolStore)
+}
+
+// poolKey is the location of an object relative to the pool root, the
+// pool/xx/rest.gz layout pr-downloader and static mirrors use.
+func poolKey(md5sum string) string {
+	return md5sum[0:2] + "/" + md5sum[2:] + ".gz"
+}
+
+// parsePoolKey is the inverse of poolKey, it returns false for anything that
+// isn't a pool object.
+func parsePoolKey(key string) (string, bool) {
+	dir, name, ok := strings.Cut(key, "/")
+	name, gz := strings.CutSuffix(name, ".gz")
+	md5sum := dir + name
+	if !ok || !gz || len(dir) != 2 || len(md5sum) != 32 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(md5sum); err != nil {
+		return "", false
+	}
+	return md5sum, true
+}
+
+// fsStore keeps the pool on the local disk under PoolPath.
+type fsStore struct {
+	root string
+}
+
+func (s *fsStore) path(md5sum string) string {
+	return filepath.Join(s.root, filepath.FromSlash(poolKey(md5sum)))
+}
+
+func (s *fsStore) Put(md5sum string, path string) error {
+	dst := s.path(md5sum)
+	dir := filepath.Dir(dst)
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		log.Printf("Creating pool path %s\n", dir)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Open returns the *os.File so copies to a connection can use sendfile.
+func (s *fsStore) Open(md5sum string) (io.ReadCloser, error) {
+	return os.Open(s.path(md5sum))
+}
+
+func (s *fsStore) Stat(md5sum string) (int64, error) {
+	fi, err := os.Stat(s.path(md5sum))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *fsStore) Delete(md5sum string) error {
+	return os.Remove(s.path(md5sum))
+}
+
+func (s *fsStore) List(fn func(md5sum string) error) error {
+	dirs, err := os.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		objects, err := os.ReadDir(filepath.Join(s.root, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			md5sum, ok := parsePoolKey(dir.Name() + "/" + obj.Name())
+			if !ok || obj.IsDir() {
+				continue
+			}
+			if err := fn(md5sum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
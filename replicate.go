@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// upstreamClient has no overall timeout, one streamer.cgi response can carry
+// a whole game.
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+func runReplicate(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("replicate", flag.ExitOnError)
+	upstream := fs.String("upstream", cfg.Upstream, "base URL of the rapid master to replicate")
+	fs.Parse(args)
+
+	if *upstream == "" {
+		return errors.New("replicate: no upstream configured")
+	}
+	cfg.Upstream = *upstream
+	return Replicate(cfg)
+}
+
+// StartReplicator keeps the server a mirror of cfg.Upstream.
+func StartReplicator(cfg Config) {
+	if cfg.Upstream == "" {
+		return
+	}
+
+	interval := time.Duration(cfg.ReplicateInterval) * time.Minute
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+
+	go func() {
+		for {
+			if err := Replicate(cfg); err != nil {
+				log.Println("Replication failed:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Replicate makes one pass over the games in the upstream repos.gz. Versions
+// already known here are only checked for new tags, the others are imported
+// with just the pool objects missing here, verified before the version is
+// created.
+func Replicate(cfg Config) error {
+	base := strings.TrimSuffix(cfg.Upstream, "/")
+
+	lines, err := readGzipLines(base + "/repos.gz")
+	if err != nil {
+		return err
+	}
+
+	// The first URL of a game is the master, the others are its mirrors
+	var order []string
+	gameURLs := make(map[string]string)
+	for _, line := range lines {
+		cols := strings.Split(line, ",")
+		if len(cols) < 2 || cols[0] == "" || !isURL(cols[1]) {
+			log.Printf("Skipping repos.gz line %q\n", line)
+			continue
+		}
+		if _, ok := gameURLs[cols[0]]; !ok {
+			order = append(order, cols[0])
+			gameURLs[cols[0]] = strings.TrimSuffix(cols[1], "/")
+		}
+	}
+
+	var failed int
+	for _, shortname := range order {
+		gameURL := gameURLs[shortname]
+
+		im := importer{
+			cfg:      cfg,
+			packages: gameURL + "/packages",
+			gameURL:  gameURL,
+			poolURL:  base + "/pool",
+		}
+		if cfg.PublicURL != "" {
+			im.repoURL = strings.TrimSuffix(cfg.PublicURL, "/") + "/" + shortname
+		}
+
+		if err := im.run(gameURL+"/versions.gz", shortname); err != nil {
+			log.Printf("Failed replicating %s: %s\n", shortname, err)
+			failed++
+			continue
+		}
+		if im.versions > 0 || im.failed > 0 {
+			log.Printf("Replicated %s: %d versions, %d aliases, %d pool objects, %d failed\n",
+				shortname, im.versions, im.aliases, im.objects, im.failed)
+		}
+		if im.failed > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d games failed", failed, len(order))
+	}
+	return nil
+}
+
+// download fetches the missing objects of a package from the upstream
+// streamer.cgi, falling back to the pool URLs for any it didn't deliver.
+func (im *importer) download(pkgMD5 string, records []SdpRecord, missing []int, files map[string]File) error {
+	err := im.streamObjects(pkgMD5, records, missing, func(i int, tmp string) error {
+		file, err := im.storeObject(records[i], tmp, "streamer.cgi")
+		if err != nil {
+			return err
+		}
+		files[file.MD5Sum] = file
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	log.Printf("%s/streamer.cgi?%s: %s, falling back to the pool\n", im.gameURL, pkgMD5, err)
+
+	for _, i := range missing {
+		if _, ok := files[hex.EncodeToString(records[i].MD5[:])]; ok {
+			continue
+		}
+		if err := im.fetchObject(records[i], files); err != nil {
+			return fmt.Errorf("%s: %w", records[i].Filename, err)
+		}
+	}
+	return nil
+}
+
+// streamObjects asks streamer.cgi for the records at the missing indexes and
+// hands each object to store as a temp file, in the order they arrive.
+func (im *importer) streamObjects(pkgMD5 string, records []SdpRecord, missing []int, store func(i int, tmp string) error) error {
+	mask := make([]byte, (len(records)+7)/8)
+	for _, i := range missing {
+		mask[i/8] |= 1 << (i % 8)
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(mask)
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	resp, err := upstreamClient.Post(im.gameURL+"/streamer.cgi?"+pkgMD5, "application/octet-stream", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	for _, i := range missing {
+		var size [4]byte
+		if _, err := io.ReadFull(resp.Body, size[:]); err != nil {
+			return fmt.Errorf("truncated response: %w", err)
+		}
+
+		n := int64(binary.BigEndian.Uint32(size[:]))
+		err := im.writeTemp(io.LimitReader(resp.Body, n), n, func(tmp string) error {
+			return store(i, tmp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchObject downloads one object from the upstream pool.
+func (im *importer) fetchObject(rec SdpRecord, files map[string]File) error {
+	src := im.poolURL + "/" + poolKey(hex.EncodeToString(rec.MD5[:]))
+
+	resp, err := upstreamClient.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", src, resp.Status)
+	}
+
+	return im.writeTemp(resp.Body, -1, func(tmp string) error {
+		file, err := im.storeObject(rec, tmp, src)
+		if err != nil {
+			return err
+		}
+		files[file.MD5Sum] = file
+		return nil
+	})
+}
+
+// writeTemp copies r into a pool temp file and calls fn with it, size is
+// checked unless negative.
+func (im *importer) writeTemp(r io.Reader, size int64, fn func(tmp string) error) error {
+	tmp, err := im.poolTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("truncated object: got %d of %d bytes", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return fn(tmp)
+}
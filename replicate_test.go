@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpstream is a rapid master serving one game: repos.gz, versions.gz,
+// the .sdp of each package, streamer.cgi and the pool. Like upq it lists
+// packages by filename, and the package md5s are given by the tests rather
+// than computed with SdpMD5, so nothing about packages comes from the code
+// under test.
+type fakeUpstream struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	// files by path, packages lists the paths of each package by tag and
+	// md5s its package md5
+	files    map[string][]byte
+	packages map[string][]string
+	md5s     map[string]string
+	// corrupt objects are served with the wrong content
+	corrupt map[string]bool
+
+	mu        sync.Mutex
+	requested [][]string
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	u := &fakeUpstream{
+		t:        t,
+		files:    make(map[string][]byte),
+		packages: make(map[string][]string),
+		md5s:     make(map[string]string),
+		corrupt:  make(map[string]bool),
+	}
+	u.srv = httptest.NewServer(u)
+	t.Cleanup(u.srv.Close)
+	return u
+}
+
+// records lists a package in upstream order, sorted by filename.
+func (u *fakeUpstream) records(tag string) []SdpRecord {
+	paths := append([]string(nil), u.packages[tag]...)
+	sort.Strings(paths)
+
+	var records []SdpRecord
+	for _, path := range paths {
+		data := u.files[path]
+		records = append(records, SdpRecord{
+			Filename: path,
+			MD5:      md5.Sum(data),
+			CRC32:    crc32.ChecksumIEEE(data),
+			Size:     uint32(len(data)),
+		})
+	}
+	return records
+}
+
+// sdp lays the records out by hand, big endian like pr-downloader reads them.
+func (u *fakeUpstream) sdp(tag string) []byte {
+	var buf []byte
+	for _, r := range u.records(tag) {
+		buf = append(buf, byte(len(r.Filename)))
+		buf = append(buf, r.Filename...)
+		buf = append(buf, r.MD5[:]...)
+		buf = binary.BigEndian.AppendUint32(buf, r.CRC32)
+		buf = binary.BigEndian.AppendUint32(buf, r.Size)
+	}
+	return buf
+}
+
+func (u *fakeUpstream) packageMD5(tag string) string {
+	md5sum, ok := u.md5s[tag]
+	if !ok {
+		u.t.Fatalf("no package md5 for %s", tag)
+	}
+	return md5sum
+}
+
+func (u *fakeUpstream) object(path string) []byte {
+	data := u.files[path]
+	if u.corrupt[path] {
+		data = append([]byte("corrupt "), data...)
+	}
+	return gzBytes(u.t, data)
+}
+
+// streamed returns the paths requested from streamer.cgi, one slice per
+// request.
+func (u *fakeUpstream) streamed() [][]string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([][]string(nil), u.requested...)
+}
+
+func (u *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var tags []string
+	for tag := range u.packages {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	switch {
+	case r.URL.Path == "/repos.gz":
+		w.Write(gzBytes(u.t, []byte("fake,"+u.srv.URL+"/fake,,\n")))
+
+	case r.URL.Path == "/fake/versions.gz":
+		var lines []string
+		for _, tag := range tags {
+			lines = append(lines, fmt.Sprintf("fake:%s,%s,,Fake %s\n", tag, u.packageMD5(tag), tag))
+		}
+		w.Write(gzBytes(u.t, []byte(strings.Join(lines, ""))))
+
+	case strings.HasPrefix(r.URL.Path, "/fake/packages/"):
+		for _, tag := range tags {
+			if r.URL.Path == "/fake/packages/"+u.packageMD5(tag)+".sdp" {
+				w.Write(gzBytes(u.t, u.sdp(tag)))
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case r.URL.Path == "/fake/streamer.cgi":
+		for _, tag := range tags {
+			if r.URL.RawQuery != u.packageMD5(tag) {
+				continue
+			}
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mask, _ := io.ReadAll(gz)
+
+			var selected []string
+			var body bytes.Buffer
+			for i, rec := range u.records(tag) {
+				if !GetBit(mask, i) {
+					continue
+				}
+				selected = append(selected, rec.Filename)
+				obj := u.object(rec.Filename)
+				binary.Write(&body, binary.BigEndian, uint32(len(obj)))
+				body.Write(obj)
+			}
+			u.mu.Lock()
+			u.requested = append(u.requested, selected)
+			u.mu.Unlock()
+
+			w.Write(body.Bytes())
+			return
+		}
+		http.NotFound(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/pool/"):
+		for path := range u.files {
+			sum := md5.Sum(u.files[path])
+			if r.URL.Path == "/pool/"+poolKey(hex.EncodeToString(sum[:])) {
+				w.Write(u.object(path))
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL and empties it. It
+// must be a throwaway postgres database, tests are skipped without one.
+func testDB(t *testing.T) Config {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	cfg := Config{DatabaseURL: url, PoolPath: t.TempDir()}
+	InitDB(cfg)
+	InitPool(cfg)
+
+	err := DB.Exec(`TRUNCATE games, game_refs, game_versions, version_aliases, version_depends,
+		channels, files, blob_files, version_files, build_jobs, mirrors RESTART IDENTITY CASCADE`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReplicate(t *testing.T) {
+	cfg := testDB(t)
+
+	up := newFakeUpstream(t)
+	up.files = map[string][]byte{
+		"modinfo.lua":      []byte("return {name='Fake'}\n"),
+		"Units/ArmCom.lua": []byte("return {armcom={}}\n"),
+		"sounds/boom.wav":  []byte("RIFF....WAVE"),
+		"maps/big.smf":     bytes.Repeat([]byte("map"), 10000),
+	}
+	up.packages = map[string][]string{
+		"git:1111111111111111111111111111111111111111": {"modinfo.lua", "Units/ArmCom.lua", "sounds/boom.wav", "maps/big.smf"},
+		"stable": {"modinfo.lua", "Units/ArmCom.lua", "sounds/boom.wav", "maps/big.smf"},
+	}
+	// md5 over md5(filename) and md5(content) of each file by filename, as
+	// upq computes it
+	up.md5s = map[string]string{
+		"git:1111111111111111111111111111111111111111": "556272d74852f99666cb449a1ced74a5",
+		"stable": "556272d74852f99666cb449a1ced74a5",
+	}
+	cfg.Upstream = up.srv.URL
+
+	// One file is already pooled here and must not be requested
+	sums, err := HashToPool(cfg, bytes.NewReader(up.files["sounds/boom.wav"]), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = insertFiles(DB, []File{{MD5Sum: sums.MD5hex, CRC32: sums.CRC32, Len: uint64(sums.Len), PoolLen: sums.PoolLen}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Replicate(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bitmask selected only the missing files, in one request
+	streamed := up.streamed()
+	if len(streamed) != 1 {
+		t.Fatalf("%d streamer.cgi requests, want 1", len(streamed))
+	}
+	got := append([]string(nil), streamed[0]...)
+	sort.Strings(got)
+	if want := "Units/ArmCom.lua,maps/big.smf,modinfo.lua"; strings.Join(got, ",") != want {
+		t.Errorf("streamed %v, want %s", got, want)
+	}
+
+	// The version is known by the upstream md5, whatever the local order
+	var version GameVersion
+	if err := DB.Preload("Aliases").Where("version_md5 = ?", "556272d74852f99666cb449a1ced74a5").First(&version).Error; err != nil {
+		t.Fatalf("version not replicated: %v", err)
+	}
+	if !version.Published || len(version.Aliases) != 1 {
+		t.Errorf("version published %v with aliases %v", version.Published, version.Aliases)
+	}
+	var ch Channel
+	if err := DB.Where("name = ?", "stable").First(&ch).Error; err != nil || ch.VersionID == nil || *ch.VersionID != version.ID {
+		t.Errorf("stable channel not pinned to the version: %+v, %v", ch, err)
+	}
+
+	// Every pool object decompresses to its file
+	for path, data := range up.files {
+		sum := md5.Sum(data)
+		md5sum := hex.EncodeToString(sum[:])
+		got, err := PoolObjectSums(md5sum)
+		if err != nil || got.MD5hex != md5sum {
+			t.Errorf("pool object of %s: %v, %v", path, got, err)
+		}
+	}
+
+	// A second pass finds nothing to do
+	var versions, files int64
+	DB.Model(&GameVersion{}).Count(&versions)
+	DB.Model(&File{}).Count(&files)
+
+	if err := Replicate(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(up.streamed()); n != 1 {
+		t.Errorf("second pass made %d more streamer.cgi requests", n-1)
+	}
+	var versions2, files2 int64
+	DB.Model(&GameVersion{}).Count(&versions2)
+	DB.Model(&File{}).Count(&files2)
+	if versions2 != versions || files2 != files {
+		t.Errorf("second pass changed %d versions to %d, %d files to %d", versions, versions2, files, files2)
+	}
+}
+
+func TestReplicateRejectsCorruptObjects(t *testing.T) {
+	cfg := testDB(t)
+
+	up := newFakeUpstream(t)
+	up.files = map[string][]byte{
+		"modinfo.lua": []byte("return {name='Fake'}\n"),
+		"bad.lua":     []byte("return {}\n"),
+	}
+	up.packages = map[string][]string{
+		"git:2222222222222222222222222222222222222222": {"modinfo.lua", "bad.lua"},
+	}
+	up.md5s = map[string]string{
+		"git:2222222222222222222222222222222222222222": "7e8e89d2574fe2ce1e75f7bbd33c5761",
+	}
+	up.corrupt["bad.lua"] = true
+	cfg.Upstream = up.srv.URL
+
+	if err := Replicate(cfg); err == nil {
+		t.Error("replicated a package with a corrupt object")
+	}
+
+	// Neither streamer.cgi nor the pool fallback got a bad object exposed
+	var versions int64
+	DB.Model(&GameVersion{}).Count(&versions)
+	if versions != 0 {
+		t.Errorf("%d versions created", versions)
+	}
+	sum := md5.Sum(up.files["bad.lua"])
+	if _, err := pool.Stat(hex.EncodeToString(sum[:])); !os.IsNotExist(err) {
+		t.Errorf("corrupt object reached the pool: %v", err)
+	}
+}
+
+// TestStreamObjects checks the streamer.cgi client on its own, it needs no
+// database.
+func TestStreamObjects(t *testing.T) {
+	up := newFakeUpstream(t)
+	for i := 0; i < 20; i++ {
+		up.files[fmt.Sprintf("file%02d.lua", i)] = []byte(strings.Repeat("x", i))
+	}
+	var paths []string
+	for path := range up.files {
+		paths = append(paths, path)
+	}
+	up.packages["test"] = paths
+	up.md5s["test"] = "fd95533334d7af8c36dfdbb92efd4239"
+	records := up.records("test")
+
+	im := importer{cfg: Config{PoolPath: t.TempDir()}, gameURL: up.srv.URL + "/fake"}
+	missing := []int{0, 7, 8, 19}
+
+	var got []int
+	err := im.streamObjects(up.packageMD5("test"), records, missing, func(i int, tmp string) error {
+		sums, err := im.objectSums(tmp)
+		if err != nil {
+			return err
+		}
+		if sums.MD5 != records[i].MD5 {
+			t.Errorf("object %d has the content of another file", i)
+		}
+		got = append(got, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(missing) {
+		t.Errorf("stored %v, want %v", got, missing)
+	}
+
+	var want []string
+	for _, i := range missing {
+		want = append(want, records[i].Filename)
+	}
+	if streamed := up.streamed(); len(streamed) != 1 || strings.Join(streamed[0], ",") != strings.Join(want, ",") {
+		t.Errorf("bitmask selected %v, want %v", streamed, want)
+	}
+
+	// Temp files are gone whether the objects were stored or not
+	if entries, _ := os.ReadDir(im.cfg.PoolPath); len(entries) != 0 {
+		t.Errorf("%d temp files left behind", len(entries))
+	}
+}
@@ -8,14 +8,17 @@ import (
 	"gorm.io/gorm"
 )
 
-func SetupRouter() *gin.Engine {
+func SetupRouter(cfg Config) *gin.Engine {
 	r := gin.Default()
 	r.Use(sessions.Sessions("admin-session", store))
 	r.LoadHTMLGlob("templates/*")
 	r.GET("/repos.gz", ReposHandler)
 	r.GET("/:shortname/versions.gz", VersionsHandler)
-	r.GET("/:shortname/packages/:filename", PackageHandler)
+	r.GET("/:shortname/packages/:filename", PackageHandler(cfg))
 	r.POST("/:shortname/streamer.cgi", StreamerHandler)
+	r.POST("/:shortname/webhook", WebhookHandler)
+	r.POST("/:shortname/upload", UploadHandler(cfg))
+	r.PUT("/:shortname/pool/:md5", UploadPoolObjectHandler(cfg))
 
 	admin := r.Group("/admin")
 	{
@@ -32,9 +35,30 @@ func SetupRouter() *gin.Engine {
 			protected.GET("/games", ListGames)
 			protected.GET("/games/new", ShowNewGame)
 			protected.POST("/games", CreateGame)
+			protected.GET("/games/:id/edit", ShowEditGame)
+			protected.POST("/games/:id", UpdateGame)
+			protected.POST("/games/:id/retention", UpdateRetention)
 
 			protected.GET("/games/:id/versions", ListVersions)
+			protected.GET("/games/:id/refs", ListRefs)
+			protected.POST("/games/:id/refs", CreateRef)
+			protected.POST("/refs/:id/delete", DeleteRef)
+
+			protected.GET("/games/:id/channels", ListChannels)
+			protected.POST("/games/:id/channels", CreateChannel)
+			protected.POST("/channels/:id", UpdateChannel)
+			protected.POST("/channels/:id/delete", DeleteChannel)
 			protected.POST("/versions/:id/togglepublish", TogglePublishVersion)
+
+			protected.GET("/mirrors", ListMirrors)
+			protected.POST("/mirrors", CreateMirror)
+			protected.POST("/mirrors/:id/toggle", ToggleMirror)
+			protected.POST("/mirrors/:id/check", CheckMirrorNow)
+			protected.POST("/mirrors/:id/delete", DeleteMirror)
+
+			protected.GET("/jobs", ListJobs)
+			protected.GET("/jobs/:id", ShowJob)
+			protected.POST("/jobs/:id/retry", RetryJob)
 		}
 	}
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Prefix is prepended to the xx/rest.gz keys, e.g. "pool/"
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UseSSL    bool   `yaml:"use_ssl"`
+}
+
+// s3Store keeps the pool in a bucket of any S3 compatible object store.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Store(cfg S3Config) (*s3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 pool store needs an endpoint and a bucket")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := client.BucketExists(context.Background(), cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3 bucket %s: %w", cfg.Bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("s3 bucket %s does not exist", cfg.Bucket)
+	}
+
+	return &s3Store{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+	}, nil
+}
+
+func (s *s3Store) key(md5sum string) string {
+	return s.prefix + poolKey(md5sum)
+}
+
+// s3Error maps missing keys to os.ErrNotExist.
+func s3Error(err error) error {
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %s", os.ErrNotExist, err)
+	}
+	return err
+}
+
+func (s *s3Store) Put(md5sum string, path string) error {
+	_, err := s.client.FPutObject(context.Background(), s.bucket, s.key(md5sum), path, minio.PutObjectOptions{
+		ContentType: "application/gzip",
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Open sends the GET right away, unlike Client.GetObject, so a missing object
+// fails here and streaming takes one round trip per object.
+func (s *s3Store) Open(md5sum string) (io.ReadCloser, error) {
+	core := minio.Core{Client: s.client}
+	body, _, _, err := core.GetObject(context.Background(), s.bucket, s.key(md5sum), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return body, nil
+}
+
+func (s *s3Store) Stat(md5sum string) (int64, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(md5sum), minio.StatObjectOptions{})
+	if err != nil {
+		return 0, s3Error(err)
+	}
+	return info.Size, nil
+}
+
+func (s *s3Store) Delete(md5sum string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(md5sum), minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) List(fn func(md5sum string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		md5sum, ok := parsePoolKey(strings.TrimPrefix(obj.Key, s.prefix))
+		if !ok {
+			continue
+		}
+		if err := fn(md5sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
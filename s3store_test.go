@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is the subset of the S3 API the pool store uses: HEAD bucket, PUT,
+// GET, HEAD and DELETE object and ListObjectsV2, path style.
+type fakeS3 struct {
+	bucket string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, S3Config) {
+	f := &fakeS3{bucket: bucket, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, S3Config{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    bucket,
+		Prefix:    "pool/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = data
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3ErrorResponse(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			f.list(w, r.URL.Query().Get("prefix"))
+		default:
+			s3ErrorResponse(w, r, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			s3ErrorResponse(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			s3ErrorResponse(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3ErrorResponse(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: "1970-01-01T00:00:00.000Z",
+				ETag:         etag(data),
+				Size:         len(data),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
+
+func s3ErrorResponse(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource></Error>`,
+			code, code, r.URL.Path)
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readS3Body decodes the aws-chunked body of a streaming signed upload, the
+// signatures themselves aren't checked.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func gzBytes(t testing.TB, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testPoolStore runs the PoolStore contract against store, objects are
+// put from temp files under dir like the pool does.
+func testPoolStore(t *testing.T, store PoolStore, dir string) {
+	t.Helper()
+
+	contents := map[string][]byte{}
+	for _, s := range []string{"first object", "second object", "third object"} {
+		sum := md5.Sum([]byte(s))
+		md5sum := hex.EncodeToString(sum[:])
+		contents[md5sum] = gzBytes(t, []byte(s))
+
+		tmp := filepath.Join(dir, poolTempPrefix+md5sum)
+		if err := os.WriteFile(tmp, contents[md5sum], 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put(md5sum, tmp); err != nil {
+			t.Fatalf("Put %s: %v", md5sum, err)
+		}
+		if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+			t.Errorf("Put left the temp file behind: %v", err)
+		}
+	}
+
+	for md5sum, data := range contents {
+		size, err := store.Stat(md5sum)
+		if err != nil || size != int64(len(data)) {
+			t.Errorf("Stat %s: %d, %v, want %d", md5sum, size, err, len(data))
+		}
+
+		r, err := store.Open(md5sum)
+		if err != nil {
+			t.Fatalf("Open %s: %v", md5sum, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Open %s: read %d bytes, %v", md5sum, len(got), err)
+		}
+	}
+
+	var listed []string
+	if err := store.List(func(md5sum string) error {
+		listed = append(listed, md5sum)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	var want []string
+	for md5sum := range contents {
+		want = append(want, md5sum)
+	}
+	sort.Strings(want)
+	if strings.Join(listed, ",") != strings.Join(want, ",") {
+		t.Errorf("List: %v, want %v", listed, want)
+	}
+
+	// Only the first object is deleted, callers may check the others
+	sum := md5.Sum([]byte("first object"))
+	md5sum := hex.EncodeToString(sum[:])
+	if err := store.Delete(md5sum); err != nil {
+		t.Fatalf("Delete %s: %v", md5sum, err)
+	}
+	if _, err := store.Stat(md5sum); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: %v, want os.ErrNotExist", err)
+	}
+	if _, err := store.Open(md5sum); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open after Delete: %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestFsStore(t *testing.T) {
+	dir := t.TempDir()
+	testPoolStore(t, &fsStore{root: dir}, dir)
+}
+
+func TestS3Store(t *testing.T) {
+	fake, cfg := newFakeS3(t, "rapid")
+
+	// Keys outside the prefix or the pool layout are not pool objects
+	fake.put("packages/0123.sdp", []byte("sdp"))
+	fake.put("pool/zz/not-an-md5.gz", []byte("junk"))
+
+	store, err := newS3Store(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPoolStore(t, store, t.TempDir())
+
+	// The objects live under the prefix in the xx/rest.gz layout
+	sum := md5.Sum([]byte("second object"))
+	md5sum := hex.EncodeToString(sum[:])
+	found := false
+	for _, key := range fake.keys() {
+		if key == "pool/"+md5sum[:2]+"/"+md5sum[2:]+".gz" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no pool/xx/rest.gz key for %s in %v", md5sum, fake.keys())
+	}
+
+	// streamer.cgi opens every object it sends, that must be a single GET
+	before := fake.requestCount()
+	r, err := store.Open(md5sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, r)
+	r.Close()
+	if n := fake.requestCount() - before; n != 1 {
+		t.Errorf("Open made %d requests, want 1", n)
+	}
+}
+
+func TestS3StoreMissingBucket(t *testing.T) {
+	_, cfg := newFakeS3(t, "rapid")
+	cfg.Bucket = "other"
+
+	if _, err := newS3Store(cfg); err == nil {
+		t.Error("opened a store on a missing bucket")
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	md5sum := "0123456789abcdef0123456789abcdef"
+	if key := poolKey(md5sum); key != "01/23456789abcdef0123456789abcdef.gz" {
+		t.Errorf("poolKey: %s", key)
+	}
+	if got, ok := parsePoolKey(poolKey(md5sum)); !ok || got != md5sum {
+		t.Errorf("parsePoolKey: %s, %v", got, ok)
+	}
+	for _, key := range []string{"", "01", "01/23.gz", "0/123456789abcdef0123456789abcdef.gz", "01/23456789abcdef0123456789abcdeg.gz", "01/23456789abcdef0123456789abcdef"} {
+		if _, ok := parsePoolKey(key); ok {
+			t.Errorf("parsePoolKey accepted %q", key)
+		}
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"sort"
+	"unicode/utf8"
 )
 
+// SdpRecord is one file of a package. A .sdp is the gzipped list of its
+// records, each a 1 byte name length, the name, the MD5 of the content and
+// the CRC32 and size as big-endian uint32, like pr-downloader reads them.
 type SdpRecord struct {
 	Filename string
 	MD5      [16]byte
@@ -13,98 +23,157 @@ type SdpRecord struct {
 	Size     uint32
 }
 
-func ReadFileRecord(r io.Reader) (*SdpRecord, error) {
-	var nameLen uint8
+const sdpMaxName = 255
 
-	// Read filename length (1 byte)
-	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
-		return nil, err
-	}
+// sdpMaxSize is the largest file a package can list and the largest pool
+// object streamer.cgi can send, both sizes are uint32 on the wire.
+const sdpMaxSize = math.MaxUint32
 
-	// Read filename bytes
-	nameBytes := make([]byte, nameLen)
-	if _, err := io.ReadFull(r, nameBytes); err != nil {
-		return nil, err
+// validSdpName checks a filename fits the one byte length and is text.
+func validSdpName(name string) error {
+	if name == "" {
+		return errors.New("sdp: empty filename")
+	}
+	if len(name) > sdpMaxName {
+		return fmt.Errorf("sdp: filename too long (max %d bytes): %.40s...", sdpMaxName, name)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("sdp: filename is not valid UTF-8: %q", name)
 	}
+	return nil
+}
 
-	var record SdpRecord
-	record.Filename = string(nameBytes)
+// SdpEncoder writes records to an uncompressed .sdp stream.
+type SdpEncoder struct {
+	w    io.Writer
+	seen map[string]bool
+}
 
-	// Read MD5 (16 bytes)
-	if _, err := io.ReadFull(r, record.MD5[:]); err != nil {
-		return nil, err
-	}
+func NewSdpEncoder(w io.Writer) *SdpEncoder {
+	return &SdpEncoder{w: w, seen: make(map[string]bool)}
+}
 
-	// Read CRC32
-	if err := binary.Read(r, binary.LittleEndian, &record.CRC32); err != nil {
-		return nil, err
+func (e *SdpEncoder) Encode(r SdpRecord) error {
+	if err := validSdpName(r.Filename); err != nil {
+		return err
 	}
-
-	// Read file size
-	if err := binary.Read(r, binary.LittleEndian, &record.Size); err != nil {
-		return nil, err
+	if e.seen[r.Filename] {
+		return fmt.Errorf("sdp: duplicate filename %s", r.Filename)
 	}
+	e.seen[r.Filename] = true
 
-	return &record, nil
-}
+	buf := make([]byte, 0, 1+len(r.Filename)+16+8)
+	buf = append(buf, uint8(len(r.Filename)))
+	buf = append(buf, r.Filename...)
+	buf = append(buf, r.MD5[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, r.CRC32)
+	buf = binary.BigEndian.AppendUint32(buf, r.Size)
 
-func ReadAllFileRecords(r io.Reader) ([]SdpRecord, error) {
-	var records []SdpRecord
+	_, err := e.w.Write(buf)
+	return err
+}
 
-	for {
-		rec, err := ReadFileRecord(r)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
+// EncodeAll writes records in the given order.
+func (e *SdpEncoder) EncodeAll(records []SdpRecord) error {
+	for _, r := range records {
+		if err := e.Encode(r); err != nil {
+			return err
 		}
-		records = append(records, *rec)
 	}
+	return nil
+}
 
-	return records, nil
+// SdpDecoder reads records from an uncompressed .sdp stream one at a time:
+//
+//	d := NewSdpDecoder(r)
+//	for d.Next() {
+//		rec := d.Record()
+//	}
+//	if err := d.Err(); err != nil {
+type SdpDecoder struct {
+	r    *bufio.Reader
+	seen map[string]bool
+	rec  SdpRecord
+	err  error
 }
 
-func WriteFileRecord(w io.Writer, record *SdpRecord) error {
-	nameLen := len(record.Filename)
+func NewSdpDecoder(r io.Reader) *SdpDecoder {
+	return &SdpDecoder{r: bufio.NewReader(r), seen: make(map[string]bool)}
+}
 
-	if nameLen > 255 {
-		return errors.New("filename too long (max 255 bytes)")
+// Next reads the next record, it returns false at the end of the stream or on
+// the first error.
+func (d *SdpDecoder) Next() bool {
+	if d.err != nil {
+		return false
 	}
 
-	// Write filename length
-	if err := binary.Write(w, binary.LittleEndian, uint8(nameLen)); err != nil {
-		return err
+	nameLen, err := d.r.ReadByte()
+	if err != nil {
+		if err != io.EOF {
+			d.err = err
+		}
+		return false
 	}
 
-	// Write filename bytes
-	if _, err := w.Write([]byte(record.Filename)); err != nil {
-		return err
+	buf := make([]byte, int(nameLen)+16+8)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = fmt.Errorf("sdp: truncated record: %w", err)
+		return false
 	}
 
-	// Write MD5 (16 bytes)
-	if _, err := w.Write(record.MD5[:]); err != nil {
-		return err
-	}
+	rec := SdpRecord{Filename: string(buf[:nameLen])}
+	copy(rec.MD5[:], buf[nameLen:])
+	rec.CRC32 = binary.BigEndian.Uint32(buf[int(nameLen)+16:])
+	rec.Size = binary.BigEndian.Uint32(buf[int(nameLen)+20:])
 
-	// Write CRC32
-	if err := binary.Write(w, binary.BigEndian, record.CRC32); err != nil {
-		return err
+	if err := validSdpName(rec.Filename); err != nil {
+		d.err = err
+		return false
 	}
-
-	// Write file size
-	if err := binary.Write(w, binary.BigEndian, record.Size); err != nil {
-		return err
+	if d.seen[rec.Filename] {
+		d.err = fmt.Errorf("sdp: duplicate filename %s", rec.Filename)
+		return false
 	}
+	d.seen[rec.Filename] = true
 
-	return nil
+	d.rec = rec
+	return true
 }
 
-func WriteAllFileRecords(w io.Writer, records []SdpRecord) error {
-	for i := range records {
-		if err := WriteFileRecord(w, &records[i]); err != nil {
-			return err
+// Record returns the record read by the last call to Next.
+func (d *SdpDecoder) Record() SdpRecord {
+	return d.rec
+}
+
+func (d *SdpDecoder) Err() error {
+	return d.err
+}
+
+// SortSdpRecords puts records in package order, by CRC32 and then filename.
+func SortSdpRecords(records []SdpRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].CRC32 != records[j].CRC32 {
+			return records[i].CRC32 < records[j].CRC32
 		}
+		return records[i].Filename < records[j].Filename
+	})
+}
+
+// SdpMD5 is the content address of a package: the MD5 over the MD5 of each
+// filename followed by the file MD5, in package order.
+func SdpMD5(records []SdpRecord) string {
+	sorted := append([]SdpRecord(nil), records...)
+	SortSdpRecords(sorted)
+
+	md5hash := md5.New()
+	for _, r := range sorted {
+		nameMd5 := md5.Sum([]byte(r.Filename))
+		md5hash.Write(nameMd5[:])
+		md5hash.Write(r.MD5[:])
 	}
-	return nil
+	return hex.EncodeToString(md5hash.Sum(nil))
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFixture returns the uncompressed content of a .sdp in testdata. The
+// fixtures use the layout pr-downloader reads, written independently of
+// SdpEncoder.
+func readFixture(t testing.TB, path string) []byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func fixtures(t testing.TB) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.sdp"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no .sdp fixtures: %v", err)
+	}
+	return paths
+}
+
+func decodeAll(data []byte) ([]SdpRecord, error) {
+	var records []SdpRecord
+	d := NewSdpDecoder(bytes.NewReader(data))
+	for d.Next() {
+		records = append(records, d.Record())
+	}
+	return records, d.Err()
+}
+
+func encodeAll(t *testing.T, records []SdpRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := NewSdpEncoder(&buf).EncodeAll(records); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSdpRoundTrip(t *testing.T) {
+	records := []SdpRecord{
+		{Filename: "modinfo.lua", MD5: md5.Sum([]byte("modinfo")), CRC32: 1, Size: 7},
+		{Filename: "units/armcom.lua", MD5: md5.Sum([]byte("armcom")), CRC32: 0xdeadbeef, Size: 6},
+		{Filename: "empty.txt", MD5: md5.Sum(nil)},
+		{Filename: strings.Repeat("x", sdpMaxName), CRC32: 0xffffffff, Size: sdpMaxSize},
+		{Filename: "maps/ünïcode.sd7", Size: 1 << 31},
+	}
+
+	got, err := decodeAll(encodeAll(t, records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("decoded %d records, want %d", len(got), len(records))
+	}
+	for i := range records {
+		if got[i] != records[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, got[i], records[i])
+		}
+	}
+}
+
+func TestSdpFixtures(t *testing.T) {
+	for _, path := range fixtures(t) {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data := readFixture(t, path)
+
+			records, err := decodeAll(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) == 0 {
+				t.Fatal("no records")
+			}
+
+			// Re-encoding in the same order gives the fixture back byte for byte
+			if out := encodeAll(t, records); !bytes.Equal(out, data) {
+				t.Errorf("re-encoded %d bytes differ from the %d byte fixture", len(out), len(data))
+			}
+		})
+	}
+}
+
+func TestSdpFixtureRecords(t *testing.T) {
+	records, err := decodeAll(readFixture(t, filepath.Join("testdata", "limits.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]uint32{
+		"a":             1,
+		"maps/huge.sd7": sdpMaxSize,
+		"empty.txt":     0,
+	}
+	for _, r := range records {
+		if size, ok := want[r.Filename]; ok && r.Size != size {
+			t.Errorf("%s: size %d, want %d", r.Filename, r.Size, size)
+		}
+		if r.Filename == "a" && r.MD5 != md5.Sum([]byte("x")) {
+			t.Errorf("a: wrong md5 %x", r.MD5)
+		}
+	}
+}
+
+// TestSdpKnownBytes decodes records written out by hand from pr-downloader's
+// reader: a length byte, the name, the md5 and then crc32 and size, each read
+// as c[0]<<24 | c[1]<<16 | c[2]<<8 | c[3]. The values are asymmetric so a
+// little endian decoder can't pass.
+func TestSdpKnownBytes(t *testing.T) {
+	data, err := hex.DecodeString("" +
+		// "modinfo.lua", md5("") d41d8cd98f00b204e9800998ecf8427e
+		"0b" + "6d6f64696e666f2e6c7561" +
+		"d41d8cd98f00b204e9800998ecf8427e" +
+		"01020304" + "00000a0b" +
+		// "maps/x.smf", 16 bytes of 0xaa, crc32 0xfedcba98, 4 GiB - 1
+		"0a" + "6d6170732f782e736d66" +
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+		"fedcba98" + "ffffffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := decodeAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SdpRecord{
+		{Filename: "modinfo.lua", MD5: md5.Sum(nil), CRC32: 0x01020304, Size: 0x0a0b},
+		{Filename: "maps/x.smf", MD5: [16]byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}, CRC32: 0xfedcba98, Size: 0xffffffff},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("decoded %d records, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, records[i], want[i])
+		}
+	}
+
+	if out := encodeAll(t, records); !bytes.Equal(out, data) {
+		t.Errorf("encoded %x, want %x", out, data)
+	}
+}
+
+// record lays out one raw record without going through the encoder, so
+// invalid ones can be built.
+func record(name string, tail int) []byte {
+	buf := []byte{byte(len(name))}
+	buf = append(buf, name...)
+	buf = append(buf, make([]byte, 16)...)
+	buf = binary.BigEndian.AppendUint32(buf, 1)
+	buf = binary.BigEndian.AppendUint32(buf, 2)
+	return buf[:len(buf)-24+tail]
+}
+
+func TestSdpDecoderErrors(t *testing.T) {
+	valid := record("modinfo.lua", 24)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty name", record("", 24)},
+		{"invalid utf-8", record("\xff\xfe.lua", 24)},
+		{"duplicate name", append(append([]byte(nil), valid...), valid...)},
+		{"name cut", []byte{10, 'a', 'b'}},
+		{"md5 cut", record("a.lua", 8)},
+		{"crc32 cut", record("a.lua", 18)},
+		{"size cut", record("a.lua", 22)},
+		{"truncated after a valid record", append(append([]byte(nil), valid...), record("b.lua", 23)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeAll(tt.data); err == nil {
+				t.Error("decoded without error")
+			}
+		})
+	}
+
+	// A clean end of stream is not an error, even without records
+	if records, err := decodeAll(nil); err != nil || len(records) != 0 {
+		t.Errorf("empty stream: %v records, err %v", len(records), err)
+	}
+}
+
+func TestSdpDecoderTruncationIsUnexpectedEOF(t *testing.T) {
+	_, err := decodeAll(record("a.lua", 20))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSdpEncoderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []SdpRecord
+	}{
+		{"empty name", []SdpRecord{{Filename: ""}}},
+		{"name too long", []SdpRecord{{Filename: strings.Repeat("x", sdpMaxName+1)}}},
+		{"invalid utf-8", []SdpRecord{{Filename: "\xff"}}},
+		{"duplicate name", []SdpRecord{{Filename: "a"}, {Filename: "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewSdpEncoder(&buf).EncodeAll(tt.records); err == nil {
+				t.Error("encoded without error")
+			}
+		})
+	}
+}
+
+func TestSdpMD5IgnoresOrder(t *testing.T) {
+	a := SdpRecord{Filename: "a", MD5: md5.Sum([]byte("a")), CRC32: 2}
+	b := SdpRecord{Filename: "b", MD5: md5.Sum([]byte("b")), CRC32: 1}
+
+	if SdpMD5([]SdpRecord{a, b}) != SdpMD5([]SdpRecord{b, a}) {
+		t.Error("package md5 depends on record order")
+	}
+	b.Filename = "B"
+	if SdpMD5([]SdpRecord{a, b}) == SdpMD5([]SdpRecord{a, {Filename: "b", MD5: b.MD5, CRC32: 1}}) {
+		t.Error("package md5 ignores filenames")
+	}
+}
+
+func FuzzSdpDecoder(f *testing.F) {
+	for _, path := range fixtures(f) {
+		f.Add(readFixture(f, path))
+	}
+	f.Add(record("a.lua", 24))
+	f.Add(record("a.lua", 10))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		records, err := decodeAll(data)
+		if err != nil {
+			return
+		}
+
+		// Whatever decodes must encode back to the same bytes
+		var buf bytes.Buffer
+		if err := NewSdpEncoder(&buf).EncodeAll(records); err != nil {
+			t.Fatalf("decoded records don't encode: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("round trip changed %d bytes into %d", len(data), buf.Len())
+		}
+	})
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploads publish content that isn't built from git, e.g. maps or games
+// packaged by an external CI. Requests carry the upload token of the game as
+// "Authorization: Bearer <token>".
+
+// Limits for one request body and for everything extracted from an archive
+const (
+	maxUploadSize      = 4 << 30
+	maxUploadExtracted = 32 << 30
+)
+
+// Prefix of the directories archives are extracted to, see CleanPool
+const uploadTempPrefix = ".upload-"
+
+var (
+	uploadTag = regexp.MustCompile(`^[A-Za-z0-9._+-]+$`)
+	md5Hex    = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// uploadManifest describes a version whose files are already in the pool,
+// either from earlier versions or uploaded to /<shortname>/pool/<md5>.
+type uploadManifest struct {
+	Tag      string         `json:"tag"`
+	FullName string         `json:"fullname"`
+	Version  string         `json:"version"`
+	Depends  []string       `json:"depends"`
+	Files    []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Path string `json:"path"`
+	MD5  string `json:"md5"`
+}
+
+// uploadGame looks up the game of the request and checks its upload token.
+func uploadGame(c *gin.Context) (Game, bool) {
+	var game Game
+	if err := DB.Where("short_name = ?", c.Param("shortname")).First(&game).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return game, false
+	}
+
+	if game.UploadToken == "" {
+		c.String(http.StatusForbidden, "uploads are disabled for this game")
+		return game, false
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(game.UploadToken)) != 1 {
+		c.String(http.StatusUnauthorized, "invalid upload token")
+		return game, false
+	}
+	return game, true
+}
+
+// UploadHandler creates a version from a multipart form with tag, fullname,
+// version, depends and a tar, tar.gz or zip archive, or from a JSON manifest.
+// A manifest referencing files missing from the pool is answered with 409
+// and the list of md5s to upload first.
+func UploadHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		game, ok := uploadGame(c)
+		if !ok {
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
+
+		var m uploadManifest
+		var entries []treeEntry
+		var openBlobs func() (blobReader, error)
+
+		if c.ContentType() == "application/json" {
+			if err := c.ShouldBindJSON(&m); err != nil {
+				c.String(http.StatusBadRequest, "invalid manifest: %s", err)
+				return
+			}
+			if err := checkUpload(game, m); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+
+			var missing []string
+			var err error
+			entries, missing, err = manifestEntries(m.Files)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			if len(missing) > 0 {
+				c.JSON(http.StatusConflict, gin.H{"missing": missing})
+				return
+			}
+			openBlobs = func() (blobReader, error) {
+				return nil, errors.New("manifest files are already pooled")
+			}
+		} else {
+			m = uploadManifest{
+				Tag:      c.PostForm("tag"),
+				FullName: c.PostForm("fullname"),
+				Version:  c.PostForm("version"),
+				Depends:  c.PostFormArray("depends"),
+			}
+			if err := checkUpload(game, m); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+
+			fh, err := c.FormFile("archive")
+			if err != nil {
+				c.String(http.StatusBadRequest, "missing archive: %s", err)
+				return
+			}
+
+			if err := os.MkdirAll(cfg.PoolPath, 0750); err != nil {
+				log.Println(err.Error())
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			dir, err := os.MkdirTemp(cfg.PoolPath, uploadTempPrefix+"*")
+			if err != nil {
+				log.Println(err.Error())
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			entries, err = extractArchive(fh, dir)
+			if err != nil {
+				c.String(http.StatusBadRequest, "invalid archive: %s", err)
+				return
+			}
+			openBlobs = func() (blobReader, error) {
+				return dirBlobs(dir), nil
+			}
+		}
+
+		version, err := uploadVersion(cfg, game, m, entries, openBlobs)
+		if err != nil {
+			log.Printf("Upload of %s:%s failed: %s\n", game.ShortName, m.Tag, err)
+			c.String(http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":          version.ID,
+			"tag":         game.ShortName + ":" + uploadAlias(m.Tag),
+			"version_md5": version.VersionMD5,
+			"fullname":    version.FullName,
+		})
+	}
+}
+
+// uploadAlias is the alias of an uploaded tag, apart from the git: aliases of
+// builds.
+func uploadAlias(tag string) string {
+	return "upload:" + tag
+}
+
+// checkUpload validates the fields that end up in versions.gz.
+func checkUpload(game Game, m uploadManifest) error {
+	if !uploadTag.MatchString(m.Tag) {
+		return fmt.Errorf("invalid tag %q", m.Tag)
+	}
+	for _, s := range append([]string{m.FullName, m.Version}, m.Depends...) {
+		if strings.ContainsAny(s, ",|\r\n") {
+			return fmt.Errorf("invalid value %q", s)
+		}
+	}
+
+	var count int64
+	DB.Model(&VersionAlias{}).Where("game_id = ? AND version_hash = ?", game.ID, uploadAlias(m.Tag)).Count(&count)
+	if count > 0 {
+		return fmt.Errorf("tag %s already exists", m.Tag)
+	}
+	return nil
+}
+
+// uploadVersion runs uploaded entries through the build pipeline. Without a
+// version the tag is substituted for $VERSION.
+func uploadVersion(cfg Config, game Game, m uploadManifest, entries []treeEntry, openBlobs func() (blobReader, error)) (*GameVersion, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("no files")
+	}
+	if m.Version == "" {
+		m.Version = m.Tag
+	}
+	jl := log.Default()
+
+	var mi *ModInfo
+	if br, err := openBlobs(); err == nil {
+		mi, err = substituteModInfo(entries, br, m.Version, jl)
+		br.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mi == nil {
+		mi = &ModInfo{}
+	}
+	mi.Version = m.Version
+	if len(m.Depends) > 0 {
+		mi.Depend = m.Depends
+	}
+
+	fullname := m.FullName
+	if fullname == "" {
+		fullname = mi.FullName()
+	}
+	if fullname == "" {
+		return nil, errors.New("fullname is required without a modinfo")
+	}
+
+	return createVersion(game, uploadAlias(m.Tag), fullname, mi, entries, openBlobs, cfg, jl)
+}
+
+// manifestEntries resolves the files of a manifest against the pool. It
+// returns the md5s that are missing instead if there are any.
+func manifestEntries(files []manifestFile) ([]treeEntry, []string, error) {
+	md5s := make([]string, 0, len(files))
+	for _, f := range files {
+		if !md5Hex.MatchString(f.MD5) {
+			return nil, nil, fmt.Errorf("invalid md5 %q for %s", f.MD5, f.Path)
+		}
+		md5s = append(md5s, f.MD5)
+	}
+
+	pooled := make(map[string]File, len(md5s))
+	for start := 0; start < len(md5s); start += insertBatchSize {
+		var rows []File
+		if err := DB.Where("md5_sum IN ?", md5s[start:min(start+insertBatchSize, len(md5s))]).Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, f := range rows {
+			pooled[f.MD5Sum] = f
+		}
+	}
+
+	var entries []treeEntry
+	var missing []string
+	reported := make(map[string]bool)
+	for _, f := range files {
+		name, err := archivePath(f.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		file, ok := pooled[f.MD5]
+		if !ok {
+			if !reported[f.MD5] {
+				missing = append(missing, f.MD5)
+				reported[f.MD5] = true
+			}
+			continue
+		}
+		entries = append(entries, treeEntry{
+			Path: name,
+			Size: int64(file.Len),
+			File: &file,
+		})
+	}
+	return entries, missing, nil
+}
+
+// archivePath normalizes a path inside an upload the way git builds do, and
+// rejects anything escaping the archive root.
+func archivePath(name string) (string, error) {
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	clean := path.Clean("/" + slashed)[1:]
+	if clean == "" || strings.HasPrefix(slashed, "/") || strings.Contains("/"+slashed+"/", "/../") {
+		return "", fmt.Errorf("invalid path %q", name)
+	}
+	return strings.ToLower(clean), nil
+}
+
+// extractArchive unpacks a tar, tar.gz or zip upload into dir. Files are
+// stored by index, so archive paths never touch the filesystem.
+func extractArchive(fh *multipart.FileHeader, dir string) ([]treeEntry, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	x := extractor{dir: dir}
+	switch {
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(f, fh.Size)
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range zr.File {
+			if !zf.Mode().IsRegular() {
+				continue
+			}
+			r, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = x.add(zf.Name, r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		var r io.Reader = f
+		if magic[0] == 0x1f && magic[1] == 0x8b {
+			gzr, err := gzip.NewReader(f)
+			if err != nil {
+				return nil, err
+			}
+			defer gzr.Close()
+			r = gzr
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := x.add(hdr.Name, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return x.entries, nil
+}
+
+type extractor struct {
+	dir     string
+	entries []treeEntry
+	total   int64
+}
+
+func (x *extractor) add(name string, r io.Reader) error {
+	p, err := archivePath(name)
+	if err != nil {
+		return err
+	}
+
+	id := strconv.Itoa(len(x.entries))
+	out, err := os.Create(filepath.Join(x.dir, id))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(r, maxUploadExtracted-x.total+1))
+	if err != nil {
+		return err
+	}
+	x.total += n
+	if x.total > maxUploadExtracted {
+		return errors.New("archive is too large")
+	}
+
+	x.entries = append(x.entries, treeEntry{
+		Path:   p,
+		Size:   n,
+		Source: id,
+	})
+	return nil
+}
+
+// dirBlobs reads the files of an extracted upload.
+type dirBlobs string
+
+func (d dirBlobs) ReadBlob(id string, fn func(io.Reader) error) error {
+	f, err := os.Open(filepath.Join(string(d), id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+func (d dirBlobs) Close() error {
+	return nil
+}
+
+// UploadPoolObjectHandler stores a gzipped pool object for a manifest upload.
+// The object must decompress to the md5 in the URL. Until a manifest uses it
+// the object is unreferenced, so gc may remove it again.
+func UploadPoolObjectHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := uploadGame(c); !ok {
+			return
+		}
+
+		md5sum := c.Param("md5")
+		if !md5Hex.MatchString(md5sum) {
+			c.String(http.StatusBadRequest, "invalid md5")
+			return
+		}
+
+		gzr, err := gzip.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize))
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid gzip: %s", err)
+			return
+		}
+		defer gzr.Close()
+
+		unlock, err := lockPool(false)
+		if err != nil {
+			log.Println(err.Error())
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		defer unlock()
+
+		// A mismatch is rejected before the object reaches the pool
+		sums, err := HashToPool(cfg, gzr, md5sum)
+		if err != nil {
+			c.String(http.StatusBadRequest, "failed storing object: %s", err)
+			return
+		}
+		if sums.Len > sdpMaxSize || sums.PoolLen > sdpMaxSize {
+			c.String(http.StatusBadRequest, "object is too large for rapid")
+			return
+		}
+
+		_, err = insertFiles(DB, []File{{
+			MD5Sum:  sums.MD5hex,
+			CRC32:   sums.CRC32,
+			SHA256:  sums.SHA256hex,
+			Len:     uint64(sums.Len),
+			PoolLen: sums.PoolLen,
+		}})
+		if err != nil {
+			log.Println(err.Error())
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"md5": sums.MD5hex, "size": sums.Len})
+	}
+}
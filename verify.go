@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PoolReport is the outcome of a pool verification.
+type PoolReport struct {
+	Checked  int
+	Missing  []File
+	Corrupt  []File
+	Orphans  []string
+	Repaired int
+}
+
+func (r *PoolReport) Broken() int {
+	return len(r.Missing) + len(r.Corrupt)
+}
+
+func runVerifyPool(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("verify-pool", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "rewrite missing and corrupt objects from the git mirrors")
+	fs.Parse(args)
+
+	report, err := VerifyPool(cfg, *repair)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range report.Missing {
+		fmt.Printf("missing %s\n", f.MD5Sum)
+	}
+	for _, f := range report.Corrupt {
+		fmt.Printf("corrupt %s\n", f.MD5Sum)
+	}
+	for _, md5sum := range report.Orphans {
+		fmt.Printf("orphan  %s\n", md5sum)
+	}
+	log.Printf("Verified %d pool objects: %d missing, %d corrupt, %d repaired, %d orphans\n",
+		report.Checked, len(report.Missing), len(report.Corrupt), report.Repaired, len(report.Orphans))
+
+	if report.Broken() > report.Repaired {
+		return errors.New("verify-pool: pool has broken objects")
+	}
+	return nil
+}
+
+// StartPoolVerifier verifies and repairs the whole pool in the background.
+func StartPoolVerifier(cfg Config) {
+	interval := time.Duration(cfg.VerifyPoolInterval) * time.Hour
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			report, err := VerifyPool(cfg, true)
+			if err != nil {
+				log.Println("Pool verification failed:", err)
+				continue
+			}
+			log.Printf("Verified %d pool objects: %d missing, %d corrupt, %d repaired, %d orphans\n",
+				report.Checked, len(report.Missing), len(report.Corrupt), report.Repaired, len(report.Orphans))
+		}
+	}()
+}
+
+// VerifyPool decompresses every pool object and checks it against its File
+// row. Objects without a row are reported as orphans but left alone, they may
+// belong to a build that hasn't committed yet.
+func VerifyPool(cfg Config, repair bool) (*PoolReport, error) {
+	report := &PoolReport{}
+	known := make(map[string]bool)
+
+	var files []File
+	err := DB.Order("id").FindInBatches(&files, 1000, func(tx *gorm.DB, batch int) error {
+		for _, f := range files {
+			known[f.MD5Sum] = true
+			report.Checked++
+
+			err := checkPoolObject(f)
+			switch {
+			case err == nil:
+				continue
+			case errors.Is(err, os.ErrNotExist):
+				report.Missing = append(report.Missing, f)
+			default:
+				log.Printf("Pool object %s: %s\n", f.MD5Sum, err)
+				report.Corrupt = append(report.Corrupt, f)
+			}
+			// streamer.cgi looks broken objects up again instead of
+			// trusting the cached size
+			DB.Model(&File{}).Where("id = ?", f.ID).Update("pool_len", 0)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	report.Orphans, err = poolOrphans(known)
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && report.Broken() > 0 {
+		report.Repaired = repairPool(cfg, append(append([]File{}, report.Missing...), report.Corrupt...))
+	}
+	return report, nil
+}
+
+// checkPoolObject compares the pool object of f with its MD5, CRC32 and length.
+func checkPoolObject(f File) error {
+	sums, err := PoolObjectSums(f.MD5Sum)
+	if err != nil {
+		return err
+	}
+	if sums.MD5hex != f.MD5Sum || sums.CRC32 != f.CRC32 || uint64(sums.Len) != f.Len {
+		return fmt.Errorf("content is %s crc %08x (%d bytes), expected %s crc %08x (%d bytes)",
+			sums.MD5hex, sums.CRC32, sums.Len, f.MD5Sum, f.CRC32, f.Len)
+	}
+
+	// Keep the size streamer.cgi announces in sync with the object
+	size, err := pool.Stat(f.MD5Sum)
+	if err != nil {
+		return err
+	}
+	if size != f.PoolLen {
+		return DB.Model(&File{}).Where("id = ?", f.ID).Update("pool_len", size).Error
+	}
+	return nil
+}
+
+// poolOrphans lists the objects of the pool store without a File row.
+func poolOrphans(known map[string]bool) ([]string, error) {
+	var orphans []string
+	err := pool.List(func(md5sum string) error {
+		if !known[md5sum] {
+			orphans = append(orphans, md5sum)
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// repairPool rewrites broken objects from the git blobs they were built from.
+// Files without a known blob, like substituted modinfos, can't be repaired.
+func repairPool(cfg Config, broken []File) int {
+	var games []Game
+	DB.Find(&games)
+
+	readers := make(map[string]*catFile)
+	defer func() {
+		for _, cf := range readers {
+			cf.Close()
+		}
+	}()
+
+	repaired := 0
+	for _, f := range broken {
+		var shas []string
+		DB.Model(&BlobFile{}).Where("file_id = ?", f.ID).Pluck("blob_sha", &shas)
+
+		if err := repairPoolObject(cfg, f, shas, games, readers); err != nil {
+			log.Printf("Failed repairing pool object %s: %s\n", f.MD5Sum, err)
+			continue
+		}
+		log.Printf("Repaired pool object %s\n", f.MD5Sum)
+		repaired++
+	}
+	return repaired
+}
+
+func repairPoolObject(cfg Config, f File, shas []string, games []Game, readers map[string]*catFile) error {
+	if len(shas) == 0 {
+		return errors.New("no git blob known")
+	}
+
+	lastErr := errors.New("blob not found in any git mirror")
+	for _, game := range games {
+		repoPath := filepath.Join(cfg.ReposPath, game.ShortName)
+		cf, ok := readers[repoPath]
+		if !ok {
+			if _, err := os.Stat(repoPath); err != nil {
+				continue
+			}
+			var err error
+			if cf, err = newCatFile(repoPath); err != nil {
+				return err
+			}
+			readers[repoPath] = cf
+		}
+
+		for _, sha := range shas {
+			var sums *FileChecksums
+			err := cf.ReadBlob(sha, func(r io.Reader) error {
+				var err error
+				sums, err = ReplacePoolObject(cfg, r, f.MD5Sum)
+				return err
+			})
+			if err != nil {
+				lastErr = fmt.Errorf("blob %s: %w", sha, err)
+				continue
+			}
+			return DB.Model(&File{}).Where("id = ?", f.ID).Update("pool_len", sums.PoolLen).Error
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Push payloads can be large for big pushes, we only need them for the HMAC.
+// Bigger ones are refused with 413 rather than failing the signature check.
+const maxWebhookBody = 25 << 20
+
+// WebhookHandler accepts GitHub, Gitea and GitLab push/tag webhooks and queues
+// the game for an immediate rebuild.
+func WebhookHandler(c *gin.Context) {
+	shortname := c.Param("shortname")
+
+	var game Game
+	if err := DB.Where("short_name = ?", shortname).First(&game).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if game.WebhookSecret == "" {
+		c.String(http.StatusForbidden, "webhooks are disabled for this game")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Println(err.Error())
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	if !verifyWebhook(c.Request.Header, body, game.WebhookSecret) {
+		c.String(http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	switch webhookEvent(c.Request.Header) {
+	case "ping":
+		c.String(http.StatusOK, "pong")
+		return
+	case "push", "create", "tag push hook", "push hook":
+	default:
+		c.String(http.StatusAccepted, "event ignored")
+		return
+	}
+
+	if !EnqueueGame(game.ID) {
+		log.Printf("A scan of %s is already pending\n", game.ShortName)
+	}
+
+	c.String(http.StatusAccepted, "queued")
+}
+
+func webhookEvent(h http.Header) string {
+	for _, name := range []string{"X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event", "X-Gitlab-Event"} {
+		if ev := h.Get(name); ev != "" {
+			return strings.ToLower(ev)
+		}
+	}
+	return ""
+}
+
+// verifyWebhook checks the HMAC-SHA256 signature sent by GitHub and Gitea, or
+// the shared token sent by GitLab.
+func verifyWebhook(h http.Header, body []byte, secret string) bool {
+	if token := h.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+
+	sig := h.Get("X-Hub-Signature-256")
+	if sig != "" {
+		sig = strings.TrimPrefix(sig, "sha256=")
+	} else if sig = h.Get("X-Gitea-Signature"); sig == "" {
+		sig = h.Get("X-Gogs-Signature")
+	}
+	if sig == "" {
+		return false
+	}
+
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
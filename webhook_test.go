@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	const secret = "s3cret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	valid := hex.EncodeToString(mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, []byte("other"))
+	mac.Write(body)
+	wrongKey := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		body   []byte
+		want   bool
+	}{
+		{"github", map[string]string{"X-Hub-Signature-256": "sha256=" + valid}, body, true},
+		{"github wrong secret", map[string]string{"X-Hub-Signature-256": "sha256=" + wrongKey}, body, false},
+		{"github changed body", map[string]string{"X-Hub-Signature-256": "sha256=" + valid}, []byte(`{"ref":"refs/heads/evil"}`), false},
+		{"github sha1 only", map[string]string{"X-Hub-Signature": "sha1=" + valid[:40]}, body, false},
+		{"gitea", map[string]string{"X-Gitea-Signature": valid}, body, true},
+		{"gitea wrong secret", map[string]string{"X-Gitea-Signature": wrongKey}, body, false},
+		{"gogs", map[string]string{"X-Gogs-Signature": valid}, body, true},
+		{"gitlab", map[string]string{"X-Gitlab-Token": secret}, body, true},
+		{"gitlab wrong token", map[string]string{"X-Gitlab-Token": "s3cre"}, body, false},
+		{"missing header", nil, body, false},
+		{"empty signature", map[string]string{"X-Gitea-Signature": ""}, body, false},
+		{"bad hex", map[string]string{"X-Hub-Signature-256": "sha256=zz" + valid[2:]}, body, false},
+		{"odd length hex", map[string]string{"X-Gitea-Signature": valid[1:]}, body, false},
+		{"truncated signature", map[string]string{"X-Gitea-Signature": valid[:32]}, body, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			if got := verifyWebhook(h, tt.body, secret); got != tt.want {
+				t.Errorf("verifyWebhook = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}